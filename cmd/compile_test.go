@@ -0,0 +1,57 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"testing"
+
+	"github.com/arduino/arduino-cslt/pkg/cslt"
+	"github.com/arduino/go-paths-helper"
+	"github.com/spf13/cobra"
+)
+
+func TestGetLibraryProperties(t *testing.T) {
+	tmpDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpDir.RemoveAll()
+	configPath := tmpDir.Join("lib.properties")
+	if err := configPath.WriteFile([]byte("author=Jane Doe\nversion=2.0.0\ncategory=Other\n")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { libConfig = "" }()
+
+	for _, test := range []struct {
+		name      string
+		libConfig string
+		args      []string
+		expected  cslt.LibraryProperties
+	}{
+		{"nothing", "", nil, cslt.LibraryProperties{}},
+		{"flags", "", []string{"--lib-author", "John Doe", "--lib-license", "MIT"}, cslt.LibraryProperties{Author: "John Doe", License: "MIT"}},
+		{"config file", configPath.String(), nil, cslt.LibraryProperties{Author: "Jane Doe", Version: "2.0.0", Category: "Other"}},
+		// the flags override the values of the config file, the other ones are kept
+		{"flags override the config file", configPath.String(), []string{"--lib-author", "John Doe", "--lib-url", "https://example.com"},
+			cslt.LibraryProperties{Author: "John Doe", Version: "2.0.0", Category: "Other", Url: "https://example.com"}},
+		// a flag set to an empty value clears the one of the config file, the default is used
+		{"empty flag", configPath.String(), []string{"--lib-category="}, cslt.LibraryProperties{Author: "Jane Doe", Version: "2.0.0"}},
+	} {
+		cmd := &cobra.Command{}
+		for _, flag := range []string{"lib-name", "lib-version", "lib-author", "lib-maintainer", "lib-sentence", "lib-paragraph", "lib-category", "lib-url", "lib-license"} {
+			cmd.Flags().String(flag, "", "")
+		}
+		if err := cmd.ParseFlags(test.args); err != nil {
+			t.Fatal(err)
+		}
+		libConfig = test.libConfig
+		props, err := getLibraryProperties(cmd)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if *props != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.name, *props, test.expected)
+		}
+	}
+}
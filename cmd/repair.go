@@ -0,0 +1,42 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/arduino/arduino-cslt/pkg/cslt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// repairCmd represents the repair command
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Restores a sketch left patched by an interrupted run.",
+	Long: `Restores a sketch left patched by an interrupted run:
+it removes the temporary files and the partial output listed in the journals of the interrupted runs,
+restores the original content of the .ino file, where setup() and loop() have been renamed to _setup() and _loop(),
+and removes the main.cpp generated by the tool. A main.cpp not generated by the tool is never removed.`,
+	Example: os.Args[0] + ` repair sketch/sketch.ino`,
+	Args:    cobra.ExactArgs(1), // the path of the sketch to repair
+	Run:     repairSketch,
+}
+
+func init() {
+	rootCmd.AddCommand(repairCmd)
+}
+
+func repairSketch(cmd *cobra.Command, args []string) {
+	logrus.Debug("repair called")
+
+	repaired, err := cslt.Repair(args[0])
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if !repaired {
+		logrus.Infof("nothing to repair in %s", args[0])
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/arduino/arduino-cslt/pkg/cslt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Checks that a precompiled sketch links again into the original firmware.",
+	Long: `Checks that a precompiled sketch links again into the original firmware:
+it compiles the sketch in the sketch-dist directory, using the precompiled library, for every board in result.json
+and compares the section sizes and the hash of the binary with the ones of the firmware built during the precompilation.`,
+	Example: os.Args[0] + ` verify sketch-dist`,
+	Args:    cobra.ExactArgs(1), // the path of the sketch-dist directory to verify
+	Run:     verifySketchDist,
+}
+
+var verifyCompileOpts cslt.CompileOptions
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringSliceVar(&verifyCompileOpts.Libraries, "libraries", nil, "Comma-separated list of directories containing libraries, passed to the arduino-cli")
+	verifyCmd.Flags().StringSliceVar(&verifyCompileOpts.Library, "library", nil, "Comma-separated list of paths of single libraries, passed to the arduino-cli")
+	verifyCmd.Flags().StringVar(&verifyCompileOpts.ConfigFile, "config-file", "", "The arduino-cli config file to use, passed to the arduino-cli")
+	verifyCmd.Flags().StringVar(&verifyCompileOpts.Warnings, "warnings", "", "The level of the warnings printed by the compiler, passed to the arduino-cli: none, default, more or all")
+}
+
+func verifySketchDist(cmd *cobra.Command, args []string) {
+	logrus.Debug("verify called")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reports, err := cslt.Verify(ctx, args[0], &verifyCompileOpts)
+	var interruptedErr *cslt.InterruptedError
+	if errors.As(err, &interruptedErr) {
+		logrus.Fatal("interrupted by a termination signal")
+	} else if err != nil {
+		logrus.Fatal(err)
+	}
+
+	mismatches := 0
+	for _, report := range reports {
+		for _, warning := range report.Warnings {
+			logrus.Warnf("%s: %s", report.Fqbn, warning)
+		}
+		if report.Matches() {
+			logrus.Infof("%s: the firmware matches", report.Fqbn)
+			continue
+		}
+		mismatches++
+		for _, difference := range report.Differences {
+			logrus.Errorf("%s: %s", report.Fqbn, difference)
+		}
+	}
+	if mismatches > 0 {
+		logrus.Fatalf("the firmware differs for %d of %d boards", mismatches, len(reports))
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/arduino/arduino-cslt/pkg/cslt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var publicKey string
+
+// verifySignatureCmd represents the verify-signature command
+var verifySignatureCmd = &cobra.Command{
+	Use:   "verify-signature",
+	Short: "Checks the signatures of a precompiled sketch.",
+	Long: `Checks the signatures of a precompiled sketch, created with compile --sign-key:
+every file of the library, including the archive of every board in result.json, and the sketch must have a valid detached signature (.sig)
+made with the private key corresponding to the public key specified. No network access is required.`,
+	Example: os.Args[0] + ` verify-signature --public-key key.pub.pem sketch-dist`,
+	Args:    cobra.ExactArgs(1), // the path of the sketch-dist directory to verify
+	Run:     verifySignatures,
+}
+
+func init() {
+	rootCmd.AddCommand(verifySignatureCmd)
+	verifySignatureCmd.Flags().StringVar(&publicKey, "public-key", "", "ed25519 public key, in a PEM file, e.g. created with: openssl pkey -in key.pem -pubout")
+	verifySignatureCmd.MarkFlagRequired("public-key")
+}
+
+func verifySignatures(cmd *cobra.Command, args []string) {
+	logrus.Debug("verify-signature called")
+
+	key, err := cslt.LoadPublicKey(publicKey)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	reports, err := cslt.VerifySignatures(args[0], key)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	invalid := 0
+	for _, report := range reports {
+		if report.Valid() {
+			logrus.Infof("%s: the signature is valid", report.Path)
+			continue
+		}
+		invalid++
+		logrus.Errorf("%s: %s", report.Path, report.Problem)
+	}
+	if invalid > 0 {
+		logrus.Fatalf("the signature is missing or not valid for %d of %d files", invalid, len(reports))
+	}
+}
@@ -1,15 +1,15 @@
-module arduino-cslt
+module github.com/arduino/arduino-cslt
 
 go 1.17
 
 require (
 	github.com/arduino/go-paths-helper v1.6.1
 	github.com/spf13/cobra v1.3.0
+	go.bug.st/relaxed-semver v0.0.0-20190922224835-391e10178d18
 )
 
 require (
 	github.com/pkg/errors v0.9.1 // indirect
-	go.bug.st/relaxed-semver v0.0.0-20190922224835-391e10178d18 // indirect
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 )
 
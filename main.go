@@ -4,7 +4,7 @@ Copyright © 2021 NAME HERE <EMAIL ADDRESS>
 */
 package main
 
-import "arduino-cslt/cmd"
+import "github.com/arduino/arduino-cslt/cmd"
 
 func main() {
 	cmd.Execute()
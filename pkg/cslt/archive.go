@@ -0,0 +1,368 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// archiveMember is an object file to add to an archive
+type archiveMember struct {
+	// name is the name of the member inside the archive
+	name    string
+	content []byte
+	mtime   time.Time
+	mode    uint32
+	// symbols contains the global symbols defined by the member, used to build the symbol index
+	symbols []string
+}
+
+// newArchiveMember reads the object file in objFilePath and returns the corresponding archiveMember,
+// the symbols are read from the ELF symbol table, or from the LTO one for the objects compiled with -flto.
+// If the file is not an ELF object it's added without symbols, while an LTO object whose symbols cannot be read is an error:
+// the archive could not be linked
+func newArchiveMember(name string, objFilePath *paths.Path) (*archiveMember, error) {
+	content, err := objFilePath.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	info, err := objFilePath.Stat()
+	if err != nil {
+		return nil, err
+	}
+	symbols, err := readDefinedSymbols(content)
+	if err != nil && isLtoObject(content) {
+		return nil, fmt.Errorf("cannot read the LTO symbols of %s: %s", objFilePath.String(), err)
+	} else if err != nil {
+		logrus.Warnf("cannot read the symbols of %s, they will not be indexed: %s", objFilePath.String(), err)
+	}
+	return &archiveMember{
+		name:    name,
+		content: content,
+		mtime:   info.ModTime(),
+		mode:    uint32(info.Mode().Perm()),
+		symbols: symbols,
+	}, nil
+}
+
+// uniqueMemberNames returns the names of the archive members corresponding to relPaths, the slash separated paths of the object files.
+// The name is the base name of the file, like `ar` does, unless it's shared by other files: in that case the
+// directories are part of the name too (e.g. src/util/helper.cpp.o is named src_util_helper.cpp.o), this way no member replaces another one
+func uniqueMemberNames(relPaths []string) []string {
+	baseNamesCount := map[string]int{}
+	for _, relPath := range relPaths {
+		baseNamesCount[path.Base(relPath)]++
+	}
+	names := make([]string, len(relPaths))
+	usedNames := map[string]bool{}
+	for i, relPath := range relPaths {
+		name := path.Base(relPath)
+		if baseNamesCount[name] > 1 {
+			name = strings.ReplaceAll(relPath, "/", "_")
+		}
+		// the name built from the path could still be taken, e.g. by a file named src_helper.cpp.o
+		for n := 1; usedNames[name]; n++ {
+			name = fmt.Sprintf("%d_%s", n, strings.ReplaceAll(relPath, "/", "_"))
+		}
+		usedNames[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// ltoSectionPrefix is the prefix of the sections containing the GCC intermediate representation of the objects compiled with -flto
+const ltoSectionPrefix = ".gnu.lto_"
+
+// ltoSymtabSectionPrefix is the prefix of the section containing the symbol table of an LTO object. The slim LTO objects
+// (-fno-fat-lto-objects, e.g. the AVR ones) only list __gnu_lto_slim in the ELF symbol table, the linker plugin and
+// gcc-ar read the symbols defined from this section instead
+const ltoSymtabSectionPrefix = ltoSectionPrefix + ".symtab."
+
+// the kinds of the symbols in the LTO symbol table, see enum gcc_plugin_symbol_kind in GCC plugin-api.h
+const (
+	ltoSymbolDef       = 0
+	ltoSymbolWeakDef   = 1
+	ltoSymbolUndef     = 2
+	ltoSymbolWeakUndef = 3
+	ltoSymbolCommon    = 4
+)
+
+// isLtoObject returns true if the ELF object content contains the GCC intermediate representation, i.e. it's compiled with -flto
+func isLtoObject(content []byte) bool {
+	elfFile, err := elf.NewFile(bytes.NewReader(content))
+	if err != nil {
+		return false
+	}
+	defer elfFile.Close()
+	for _, section := range elfFile.Sections {
+		if strings.HasPrefix(section.Name, ltoSectionPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectSymbol is a global symbol of an object file, as seen by the linker
+type objectSymbol struct {
+	name string
+	// undefined is true if the object references the symbol without defining it
+	undefined bool
+	// weak is true if the symbol is weak, the linker uses a non weak definition instead if available
+	weak bool
+}
+
+// readDefinedSymbols returns the symbols defined in the ELF object content that are visible to the linker
+// when it searches the archive: the global, weak and unique ones, common symbols included.
+// For the LTO objects the symbols are the ones of the LTO symbol table, like gcc-ar does
+func readDefinedSymbols(content []byte) ([]string, error) {
+	objectSymbols, err := readObjectSymbols(content)
+	if err != nil {
+		return nil, err
+	}
+	var symbols []string
+	for _, symbol := range objectSymbols {
+		if !symbol.undefined {
+			symbols = append(symbols, symbol.name)
+		}
+	}
+	return symbols, nil
+}
+
+// readObjectSymbols returns the global symbols, defined or referenced, of the ELF object content.
+// For the LTO objects the symbols are the ones of the LTO symbol table, the ELF one only contains the LTO markers
+func readObjectSymbols(content []byte) ([]*objectSymbol, error) {
+	elfFile, err := elf.NewFile(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer elfFile.Close()
+	isLto := false
+	for _, section := range elfFile.Sections {
+		if strings.HasPrefix(section.Name, ltoSymtabSectionPrefix) {
+			data, err := section.Data()
+			if err != nil {
+				return nil, err
+			}
+			return readLtoSymbols(data)
+		}
+		isLto = isLto || strings.HasPrefix(section.Name, ltoSectionPrefix)
+	}
+	if isLto {
+		return nil, fmt.Errorf("the LTO symbol table (%s*) is missing", ltoSymtabSectionPrefix)
+	}
+	elfSymbols, err := elfFile.Symbols()
+	if err == elf.ErrNoSymbols {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var symbols []*objectSymbol
+	for _, symbol := range elfSymbols {
+		switch elf.ST_BIND(symbol.Info) {
+		case elf.STB_GLOBAL, elf.STB_WEAK, elf.STB_LOOS: // STB_LOOS is STB_GNU_UNIQUE
+		default:
+			continue
+		}
+		if symbol.Name == "" {
+			continue
+		}
+		symbols = append(symbols, &objectSymbol{
+			name:      symbol.Name,
+			undefined: symbol.Section == elf.SHN_UNDEF,
+			weak:      elf.ST_BIND(symbol.Info) == elf.STB_WEAK,
+		})
+	}
+	return symbols, nil
+}
+
+// readLtoSymbols returns the symbols of the LTO symbol table symtab, every entry contains:
+// the name and the comdat group, NUL terminated, the kind and the visibility (1 byte each), the size (8 bytes) and the slot (4 bytes)
+func readLtoSymbols(symtab []byte) ([]*objectSymbol, error) {
+	var symbols []*objectSymbol
+	for len(symtab) > 0 {
+		nameEnd := bytes.IndexByte(symtab, 0)
+		if nameEnd < 0 {
+			return nil, errors.New("invalid LTO symbol table")
+		}
+		name := string(symtab[:nameEnd])
+		symtab = symtab[nameEnd+1:]
+		comdatEnd := bytes.IndexByte(symtab, 0)
+		if comdatEnd < 0 || len(symtab) < comdatEnd+1+14 {
+			return nil, errors.New("invalid LTO symbol table")
+		}
+		kind := symtab[comdatEnd+1]
+		symtab = symtab[comdatEnd+1+14:]
+		switch kind {
+		case ltoSymbolDef, ltoSymbolCommon:
+			symbols = append(symbols, &objectSymbol{name: name})
+		case ltoSymbolWeakDef:
+			symbols = append(symbols, &objectSymbol{name: name, weak: true})
+		case ltoSymbolUndef:
+			symbols = append(symbols, &objectSymbol{name: name, undefined: true})
+		case ltoSymbolWeakUndef:
+			symbols = append(symbols, &objectSymbol{name: name, undefined: true, weak: true})
+		}
+	}
+	return symbols, nil
+}
+
+// readArchiveMembers returns the content of the members of the ar archive content, the symbol index and the long names table excluded
+func readArchiveMembers(content []byte) ([][]byte, error) {
+	if !bytes.HasPrefix(content, []byte(arMagic)) {
+		return nil, errors.New("not an ar archive")
+	}
+	var members [][]byte
+	for offset := len(arMagic); offset+arHeaderSize <= len(content); {
+		header := content[offset : offset+arHeaderSize]
+		size, err := strconv.Atoi(strings.TrimSpace(string(header[48:58])))
+		if err != nil || offset+arHeaderSize+size > len(content) {
+			return nil, errors.New("invalid ar archive")
+		}
+		name := strings.TrimSpace(string(header[:16]))
+		if name != "/" && name != "//" && name != "/SYM64/" {
+			members = append(members, content[offset+arHeaderSize:offset+arHeaderSize+size])
+		}
+		offset += arHeaderSize + padded(size)
+	}
+	return members, nil
+}
+
+// writeArchive writes the members in a GNU/SysV ar archive in archivePath, the archive contains:
+// - the symbol index (the "/" member), needed by the linker to find which member defines a symbol
+// - the long names table (the "//" member), if a member name doesn't fit in the header
+// - the members, in the given order
+// The result is equivalent to the one of `ar rcs`. If deterministic is true the result is equivalent to the one of `ar rcsD`
+// with the members sorted by name: the mtimes, uids and gids are 0 and the modes 0644, this way the archive only depends on the members content
+func writeArchive(archivePath *paths.Path, members []*archiveMember, deterministic bool) error {
+	symbolIndexMtime := time.Now()
+	if deterministic {
+		symbolIndexMtime = time.Time{}
+		sortedMembers := make([]*archiveMember, len(members))
+		for i, member := range members {
+			sortedMembers[i] = &archiveMember{name: member.name, content: member.content, mode: 0644, symbols: member.symbols}
+		}
+		sort.SliceStable(sortedMembers, func(i, j int) bool { return sortedMembers[i].name < sortedMembers[j].name })
+		members = sortedMembers
+	}
+
+	// the long names table contains the names longer than 15 chars, the member header refers to them by offset
+	var longNames bytes.Buffer
+	headerNames := make([]string, len(members))
+	for i, member := range members {
+		if len(member.name) < 16 {
+			headerNames[i] = member.name + "/"
+			continue
+		}
+		headerNames[i] = "/" + strconv.Itoa(longNames.Len())
+		longNames.WriteString(member.name + "/\n")
+	}
+
+	// the symbol index contains the offsets of the members headers: to calculate them we need
+	// the size of the symbol index and of the long names table, that come before the members
+	symbolsCount := 0
+	symbolNamesSize := 0
+	for _, member := range members {
+		symbolsCount += len(member.symbols)
+		for _, symbol := range member.symbols {
+			symbolNamesSize += len(symbol) + 1
+		}
+	}
+	offset := len(arMagic)
+	if symbolsCount > 0 {
+		offset += arHeaderSize + padded(4+4*symbolsCount+symbolNamesSize)
+	}
+	if longNames.Len() > 0 {
+		offset += arHeaderSize + padded(longNames.Len())
+	}
+	membersOffsets := make([]int, len(members))
+	for i, member := range members {
+		membersOffsets[i] = offset
+		offset += arHeaderSize + padded(len(member.content))
+	}
+
+	var archive bytes.Buffer
+	archive.WriteString(arMagic)
+	if symbolsCount > 0 {
+		var symbolIndex bytes.Buffer
+		binary.Write(&symbolIndex, binary.BigEndian, uint32(symbolsCount))
+		for i, member := range members {
+			for range member.symbols {
+				binary.Write(&symbolIndex, binary.BigEndian, uint32(membersOffsets[i]))
+			}
+		}
+		for _, member := range members {
+			for _, symbol := range member.symbols {
+				symbolIndex.WriteString(symbol + "\x00")
+			}
+		}
+		if err := writeArchiveEntry(&archive, "/", symbolIndexMtime, 0, symbolIndex.Bytes()); err != nil {
+			return err
+		}
+	}
+	if longNames.Len() > 0 {
+		if err := writeArchiveEntry(&archive, "//", time.Time{}, 0, longNames.Bytes()); err != nil {
+			return err
+		}
+	}
+	for i, member := range members {
+		if err := writeArchiveEntry(&archive, headerNames[i], member.mtime, 0100000|member.mode, member.content); err != nil {
+			return err
+		}
+	}
+
+	return archivePath.WriteFile(archive.Bytes())
+}
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+)
+
+// writeArchiveEntry writes in archive the 60 bytes header, followed by the content, padded to an even size.
+// A zero mtime is written as 0, and so is a 0 mode: this is how the special members (symbol index and long names) are written
+func writeArchiveEntry(archive *bytes.Buffer, name string, mtime time.Time, mode uint32, content []byte) error {
+	var mtimeField, modeField string
+	if !mtime.IsZero() {
+		mtimeField = strconv.FormatInt(mtime.Unix(), 10)
+	} else if name != "//" {
+		mtimeField = "0"
+	}
+	if mode != 0 {
+		modeField = strconv.FormatUint(uint64(mode), 8)
+	} else if name != "//" {
+		modeField = "0"
+	}
+	uidGidField := ""
+	if name != "//" {
+		uidGidField = "0"
+	}
+	header := fmt.Sprintf("%-16s%-12s%-6s%-6s%-8s%-10d`\n", name, mtimeField, uidGidField, uidGidField, modeField, len(content))
+	if len(header) != arHeaderSize {
+		return fmt.Errorf("cannot write the archive header of %s", name)
+	}
+	archive.WriteString(header)
+	archive.Write(content)
+	if len(content)%2 != 0 {
+		archive.WriteByte('\n')
+	}
+	return nil
+}
+
+// padded returns size rounded up to an even number, ar aligns the members to 2 bytes
+func padded(size int) int {
+	return size + size%2
+}
@@ -0,0 +1,220 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// readTestArchive parses the ar archive in archivePath, it returns the content of the members by name
+// and the symbol index as symbol -> member name
+func readTestArchive(t *testing.T, archivePath *paths.Path) ([]string, map[string][]byte, map[string]string) {
+	content, err := archivePath.ReadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(content, []byte(arMagic)) {
+		t.Fatalf("missing ar magic")
+	}
+	offset := len(arMagic)
+	var names []string
+	members := map[string][]byte{}
+	offsets := map[int]string{}
+	var symbolIndex, longNames []byte
+	for offset < len(content) {
+		header := string(content[offset : offset+arHeaderSize])
+		size, err := strconv.Atoi(strings.TrimSpace(header[48:58]))
+		if err != nil {
+			t.Fatalf("invalid size in header %q", header)
+		}
+		data := content[offset+arHeaderSize : offset+arHeaderSize+size]
+		name := strings.TrimSpace(header[:16])
+		switch {
+		case name == "/":
+			symbolIndex = data
+		case name == "//":
+			longNames = data
+		default:
+			if strings.HasPrefix(name, "/") {
+				start, _ := strconv.Atoi(name[1:])
+				name = string(longNames[start:])
+				name = name[:strings.Index(name, "\n")]
+			}
+			name = strings.TrimSuffix(name, "/")
+			names = append(names, name)
+			members[name] = data
+			offsets[offset] = name
+		}
+		offset += arHeaderSize + padded(size)
+	}
+
+	symbols := map[string]string{}
+	if symbolIndex != nil {
+		count := int(symbolIndex[0])<<24 | int(symbolIndex[1])<<16 | int(symbolIndex[2])<<8 | int(symbolIndex[3])
+		symbolNames := strings.Split(string(symbolIndex[4+4*count:]), "\x00")
+		for i := 0; i < count; i++ {
+			b := symbolIndex[4+4*i:]
+			memberOffset := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+			if _, ok := offsets[memberOffset]; !ok {
+				t.Fatalf("symbol %s points to %d, that is not a member", symbolNames[i], memberOffset)
+			}
+			symbols[symbolNames[i]] = offsets[memberOffset]
+		}
+	}
+	return names, members, symbols
+}
+
+func TestWriteArchiveRoundTrip(t *testing.T) {
+	dir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.RemoveAll()
+
+	mtime := time.Unix(1600000000, 0)
+	members := []*archiveMember{
+		{name: "sketch.ino.cpp.o", content: []byte("odd"), mtime: mtime, mode: 0600, symbols: []string{"_setup", "_loop"}},
+		{name: "a_very_long_member_name.cpp.o", content: []byte("even"), mtime: mtime, mode: 0644, symbols: []string{"helper"}},
+		{name: "empty.c.o", content: []byte{}, mtime: mtime, mode: 0644},
+	}
+	for _, deterministic := range []bool{false, true} {
+		archivePath := dir.Join("lib" + strconv.FormatBool(deterministic) + ".a")
+		if err := writeArchive(archivePath, members, deterministic); err != nil {
+			t.Fatal(err)
+		}
+		names, contents, symbols := readTestArchive(t, archivePath)
+		expectedNames := []string{"sketch.ino.cpp.o", "a_very_long_member_name.cpp.o", "empty.c.o"}
+		if deterministic {
+			expectedNames = []string{"a_very_long_member_name.cpp.o", "empty.c.o", "sketch.ino.cpp.o"}
+		}
+		if strings.Join(names, ",") != strings.Join(expectedNames, ",") {
+			t.Errorf("deterministic=%v: members are %v, expected %v", deterministic, names, expectedNames)
+		}
+		for _, member := range members {
+			if !bytes.Equal(contents[member.name], member.content) {
+				t.Errorf("deterministic=%v: content of %s is %q, expected %q", deterministic, member.name, contents[member.name], member.content)
+			}
+			for _, symbol := range member.symbols {
+				if symbols[symbol] != member.name {
+					t.Errorf("deterministic=%v: symbol %s is in %q, expected %s", deterministic, symbol, symbols[symbol], member.name)
+				}
+			}
+		}
+	}
+
+	// the deterministic archive only depends on the members content
+	first, _ := dir.Join("libtrue.a").ReadFile()
+	for _, member := range members {
+		member.mtime = time.Now()
+	}
+	if err := writeArchive(dir.Join("again.a"), members, true); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := dir.Join("again.a").ReadFile()
+	if !bytes.Equal(first, second) {
+		t.Errorf("the deterministic archive depends on the mtimes")
+	}
+}
+
+func TestWriteArchiveLinks(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not installed")
+	}
+	dir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.RemoveAll()
+	sources := map[string]string{
+		"setup.c": "int counter;\nstatic int helper(int x) { return x + 1; }\nvoid _setup(void) { counter = helper(counter); }\n",
+		"loop.c":  "extern int counter;\n__attribute__((weak)) int _loop(void) { return counter; }\n",
+		"main.c":  "void _setup(void);\nint _loop(void);\nint main(void) { _setup(); return _loop() == 1 ? 0 : 1; }\n",
+	}
+	for name, source := range sources {
+		if err := dir.Join(name).WriteFile([]byte(source)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name  string
+		flags []string
+	}{
+		{"plain", nil},
+		// the AVR cores compile like this, the objects only contain the intermediate representation
+		{"slim-lto", []string{"-flto", "-fno-fat-lto-objects"}},
+		{"fat-lto", []string{"-flto", "-ffat-lto-objects"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buildDir := dir.Join(test.name)
+			if err := buildDir.MkdirAll(); err != nil {
+				t.Fatal(err)
+			}
+			gcc := func(args ...string) {
+				cmd := exec.Command("gcc", append(append([]string{}, test.flags...), args...)...)
+				cmd.Dir = buildDir.String()
+				if output, err := cmd.CombinedOutput(); err != nil {
+					t.Fatalf("gcc %s: %s\n%s", strings.Join(args, " "), err, output)
+				}
+			}
+			var members []*archiveMember
+			for _, name := range []string{"setup.c", "loop.c", "main.c"} {
+				gcc("-O2", "-c", dir.Join(name).String(), "-o", name+".o")
+				if name == "main.c" {
+					continue
+				}
+				member, err := newArchiveMember(name+".o", buildDir.Join(name+".o"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				members = append(members, member)
+			}
+			archivePath := buildDir.Join("libsketch.a")
+			if err := writeArchive(archivePath, members, true); err != nil {
+				t.Fatal(err)
+			}
+			_, _, symbols := readTestArchive(t, archivePath)
+			for _, symbol := range []string{"_setup", "_loop", "counter"} {
+				if symbols[symbol] == "" {
+					t.Errorf("symbol %s is not indexed: %v", symbol, symbols)
+				}
+			}
+			if _, ok := symbols["__gnu_lto_slim"]; ok {
+				t.Errorf("the LTO marker is indexed: %v", symbols)
+			}
+			gcc("main.c.o", "-L.", "-lsketch", "-o", "firmware")
+			if output, err := exec.Command(buildDir.Join("firmware").String()).CombinedOutput(); err != nil {
+				t.Errorf("the firmware linked with the archive doesn't work: %s\n%s", err, output)
+			}
+		})
+	}
+}
+
+func TestUniqueMemberNames(t *testing.T) {
+	for _, test := range []struct {
+		relPaths []string
+		expected []string
+	}{
+		{nil, []string{}},
+		{[]string{"sketch.ino.cpp.o", "helper.cpp.o"}, []string{"sketch.ino.cpp.o", "helper.cpp.o"}},
+		{[]string{"src/helper.cpp.o", "src/util/other.c.o"}, []string{"helper.cpp.o", "other.c.o"}},
+		{[]string{"helper.cpp.o", "src/helper.cpp.o", "src/util/helper.cpp.o"}, []string{"helper.cpp.o", "src_helper.cpp.o", "src_util_helper.cpp.o"}},
+		// the name built from the path is taken by another file
+		{[]string{"src_helper.cpp.o", "src/helper.cpp.o", "helper.cpp.o"}, []string{"src_helper.cpp.o", "1_src_helper.cpp.o", "helper.cpp.o"}},
+		{[]string{"a/b_c.o", "a_b/c.o", "c.o", "b_c.o"}, []string{"a_b_c.o", "1_a_b_c.o", "c.o", "b_c.o"}},
+	} {
+		names := uniqueMemberNames(test.relPaths)
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%v: names are %v, expected %v", test.relPaths, names, test.expected)
+		}
+	}
+}
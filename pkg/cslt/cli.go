@@ -0,0 +1,460 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+	semver "go.bug.st/relaxed-semver"
+)
+
+// cliCompileOutput represents the json returned by the arduino-cli compile command
+type cliCompileOutput struct {
+	CompilerOut   string            `json:"compiler_out"`
+	CompilerErr   string            `json:"compiler_err"`
+	BuilderResult *cliBuilderResult `json:"builder_result"`
+	Success       bool              `json:"success"`
+}
+
+// cliBuilderResult contains the informations regarding the build returned by the arduino-cli compile command
+type cliBuilderResult struct {
+	BuildPath     string         `json:"build_path"`
+	UsedLibraries []*UsedLibrary `json:"used_libraries"`
+	BuildPlatform *BuildPlatform `json:"build_platform"`
+}
+
+// sketchObjFileSuffixes are the suffixes of the object files compiled from the sketch sources: the .ino files are
+// converted to a .cpp file, the .c, .cpp and .S files can be both in the sketch folder and in its src subfolder
+var sketchObjFileSuffixes = []string{".c.o", ".cpp.o", ".S.o"}
+
+// precompiledCoreRegexp matches the line of the verbose output telling that the core archived by a previous build has been used,
+// in that case the core objects are not in the build directory
+var precompiledCoreRegexp = regexp.MustCompile(`(?m)^Using precompiled core: (.+?)\r?$`)
+
+// fqbnReplacer is used to turn an fqbn in a valid directory name
+var fqbnReplacer = strings.NewReplacer(":", "_", ",", "_", "=", "_")
+
+// compileTarget will compile the sketch in inoPath for the board identified by fqbn,
+// the build directory is created inside stagingDir, this way it gets removed together with the staged sketch.
+// the compileOpts are passed to both the arduino-cli compile commands, the ones changing the binary are recorded in the Target.
+// it returns a Target containing the {build.mcu}, the core and libraries used, the object files produced and the firmware linked
+func compileTarget(ctx context.Context, fqbn string, inoPath, stagingDir *paths.Path, compileOpts *CompileOptions) (*Target, error) {
+	buildPath := stagingDir.Join("build", fqbnReplacer.Replace(fqbn))
+
+	// let's call arduino-cli compile and parse the verbose output
+	cmdArgs := []string{"compile", "-b", compileOpts.fqbn(fqbn), inoPath.String(), "--build-path", buildPath.String(), "-v", "--format", "json"}
+	cmdArgs = append(cmdArgs, compileOpts.args()...)
+	logrus.Infof("running: arduino-cli %s", strings.Join(cmdArgs, " "))
+	cmdOutput, err := exec.CommandContext(ctx, "arduino-cli", cmdArgs...).Output()
+	if err != nil {
+		// the json output, if any, contains the errors of the compiler
+		var compileOutput cliCompileOutput
+		json.Unmarshal(cmdOutput, &compileOutput)
+		return nil, &CompileError{Fqbn: fqbn, CompilerErr: compileOutput.CompilerErr, Err: err}
+	}
+
+	target, err := parseCliCompileOutput(fqbn, cmdOutput)
+	if err != nil {
+		return nil, err
+	}
+	target.CompileOptions = compileOpts.recorded()
+
+	// this is done to get the build properties, like {build.mcu}, used later to create the lib dir structure
+	// the --show-properties will only print on stdout and not compile
+	// the json output is currently broken with this flag, see https://github.com/arduino/arduino-cli/issues/1628
+	cmdArgs = []string{"compile", "-b", compileOpts.fqbn(fqbn), inoPath.String(), "--build-path", buildPath.String(), "--show-properties"}
+	cmdArgs = append(cmdArgs, compileOpts.args()...)
+	logrus.Infof("running: arduino-cli %s", strings.Join(cmdArgs, " "))
+	cmdOutput, err = exec.CommandContext(ctx, "arduino-cli", cmdArgs...).Output()
+	if err != nil {
+		return nil, &CompileError{Fqbn: fqbn, Err: err}
+	}
+
+	if target.buildProperties, err = parseCliCompileOutputShowProp(fqbn, cmdOutput); err != nil {
+		return nil, err
+	}
+	target.BuildMcu, _ = target.buildProperties.get("build.mcu")
+	target.BuildBoard, _ = target.buildProperties.get("build.board")
+	target.PrecompiledFolder = precompiledFolder(target.buildProperties)
+	if target.BuildMcu == "" {
+		logrus.Warnf("build.mcu is not defined for %s, the archive will be placed in the src/%s folder of the library", fqbn, target.PrecompiledFolder)
+	}
+
+	// the build platform is the one providing the core, that can be different from the platform of the board
+	if coreDir := target.platformDir("build.core.path", "cores"); target.CoreInfo != nil && target.CoreInfo.InstallDir == "" && coreDir != nil {
+		target.CoreInfo.InstallDir = coreDir.String()
+	}
+	// a board can use the core or the variant of another platform, all of them must be installed to build it again
+	target.BoardPlatform = target.platformOf("runtime.platform.path", "")
+	target.CorePlatform = target.platformOf("build.core.path", "cores")
+	target.VariantPlatform = target.platformOf("build.variant.path", "variants")
+	detectLicenses(target)
+	for _, lib := range target.LibsInfo {
+		if lib.Repository == "" {
+			lib.Repository = findGitRepository(lib.InstallDir)
+		}
+	}
+
+	// the firmware is recorded to be able to verify that the library links again into the same binary
+	firmwarePath := buildPath.Join(inoPath.Base() + ".elf")
+	if target.Firmware, err = readFirmware(firmwarePath); err != nil {
+		logrus.Warnf("the firmware for %s will not be verifiable: %s", fqbn, err)
+	}
+	return target, nil
+}
+
+// validate checks the compile options, the nil CompileOptions are valid
+func (o *CompileOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	switch o.Warnings {
+	case "", "none", "default", "more", "all":
+	default:
+		return &InvalidOptionsError{Reason: fmt.Sprintf("invalid warnings level %q, it must be none, default, more or all", o.Warnings)}
+	}
+	for _, option := range o.BoardOptions {
+		if !strings.Contains(option, "=") || strings.ContainsAny(option, ":,") {
+			return &InvalidOptionsError{Reason: fmt.Sprintf("invalid board option %q, it must be option=value", option)}
+		}
+	}
+	for _, property := range o.BuildProperties {
+		if !strings.Contains(property, "=") {
+			return &InvalidOptionsError{Reason: fmt.Sprintf("invalid build property %q, it must be key=value", property)}
+		}
+	}
+	return nil
+}
+
+// fqbn returns fqbn with the board options added, the arduino-cli reads them from the fourth part of the fqbn
+// (e.g. arduino:avr:nano:cpu=atmega328old) since its first versions
+func (o *CompileOptions) fqbn(fqbn string) string {
+	if o == nil || len(o.BoardOptions) == 0 {
+		return fqbn
+	}
+	if strings.Count(fqbn, ":") >= 3 {
+		return fqbn + "," + strings.Join(o.BoardOptions, ",")
+	}
+	return fqbn + ":" + strings.Join(o.BoardOptions, ",")
+}
+
+// args returns the flags of the arduino-cli compile command corresponding to all the options, except the board options that are in the fqbn
+func (o *CompileOptions) args() []string {
+	return append(o.recordedArgs(), o.localArgs()...)
+}
+
+// recordedArgs returns the flags of the arduino-cli compile command corresponding to the options changing the binary,
+// the ones recorded in result.json, except the board options that are in the fqbn
+func (o *CompileOptions) recordedArgs() []string {
+	if o == nil {
+		return nil
+	}
+	var args []string
+	for _, property := range o.BuildProperties {
+		args = append(args, "--build-property", property)
+	}
+	if o.OptimizeForDebug {
+		args = append(args, "--optimize-for-debug")
+	}
+	return args
+}
+
+// localArgs returns the flags of the arduino-cli compile command corresponding to the options not recorded in result.json,
+// the ones containing local paths or only changing the messages of the compiler
+func (o *CompileOptions) localArgs() []string {
+	if o == nil {
+		return nil
+	}
+	var args []string
+	if len(o.Libraries) > 0 {
+		args = append(args, "--libraries", strings.Join(o.Libraries, ","))
+	}
+	for _, library := range o.Library {
+		args = append(args, "--library", library)
+	}
+	if o.ConfigFile != "" {
+		args = append(args, "--config-file", o.ConfigFile)
+	}
+	if o.Warnings != "" {
+		args = append(args, "--warnings", o.Warnings)
+	}
+	return args
+}
+
+// recorded returns the options changing the binary, the ones recorded in result.json, or nil if there aren't any
+func (o *CompileOptions) recorded() *CompileOptions {
+	if o == nil || (len(o.BuildProperties) == 0 && len(o.BoardOptions) == 0 && !o.OptimizeForDebug) {
+		return nil
+	}
+	return &CompileOptions{BuildProperties: o.BuildProperties, BoardOptions: o.BoardOptions, OptimizeForDebug: o.OptimizeForDebug}
+}
+
+// commandLine returns the flags recorded in the options as they are typed in a shell, quoting the values containing spaces
+func (o *CompileOptions) commandLine() string {
+	var args []string
+	for _, arg := range o.recordedArgs() {
+		if strings.ContainsAny(arg, " \t\"'") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// platformDir returns the directory of the platform containing the directory in the build property named dirProperty, e.g. build.core.path.
+// If subdir is not empty the directory is the one of a core or of a variant, inside the subdir folder of the platform (e.g. cores/arduino).
+// It returns nil if the directory is not set or it's not inside the subdir folder
+func (t *Target) platformDir(dirProperty, subdir string) *paths.Path {
+	dir, _ := t.buildProperties.get(dirProperty)
+	if dir = t.buildProperties.expand(dir); dir == "" {
+		return nil
+	}
+	platformDir := paths.New(dir).Clean()
+	if subdir != "" {
+		if platformDir.Parent().Base() != subdir {
+			return nil
+		}
+		platformDir = platformDir.Parent().Parent()
+	}
+	return platformDir
+}
+
+// platformOf returns the platform installed in the directory returned by platformDir.
+// The platforms installed with the arduino-cli are in .../packages/{packager}/hardware/{architecture}/{version},
+// the ones installed manually in the sketchbook in .../hardware/{packager}/{architecture}: their version is taken from platform.txt.
+// It returns nil if the directory is not set or it's not inside a platform
+func (t *Target) platformOf(dirProperty, subdir string) *BuildPlatform {
+	platformDir := t.platformDir(dirProperty, subdir)
+	if platformDir == nil {
+		if dir, _ := t.buildProperties.get(dirProperty); dir != "" {
+			logrus.Warnf("cannot find the platform of %s=%s for %s", dirProperty, dir, t.Fqbn)
+		}
+		return nil
+	}
+	if t.CoreInfo != nil && t.CoreInfo.InstallDir != "" && paths.New(t.CoreInfo.InstallDir).Clean().EqualsTo(platformDir) {
+		return t.CoreInfo
+	}
+
+	platform := &BuildPlatform{InstallDir: platformDir.String()}
+	if hardwareDir := platformDir.Parent().Parent(); hardwareDir.Base() == "hardware" && hardwareDir.Parent().Parent().Base() == "packages" {
+		platform.Id = hardwareDir.Parent().Base() + ":" + platformDir.Parent().Base()
+		platform.Version = platformDir.Base()
+	} else if hardwareDir := platformDir.Parent().Parent(); hardwareDir.Base() == "hardware" {
+		platform.Id = platformDir.Parent().Base() + ":" + platformDir.Base()
+		if content, err := platformDir.Join("platform.txt").ReadFile(); err == nil {
+			if props, err := parseProperties(content); err == nil {
+				platform.Version, _ = props.get("version")
+			}
+		}
+	} else {
+		logrus.Warnf("cannot find the platform of %s=%s for %s", dirProperty, platformDir, t.Fqbn)
+		return nil
+	}
+	return platform
+}
+
+// platforms returns the platforms used to compile the sketch for the target, every platform is listed once:
+// the one reported by the arduino-cli first, then the ones of the board, of the core and of the variant
+func (t *Target) platforms() []*BuildPlatform {
+	var platforms []*BuildPlatform
+	for _, platform := range []*BuildPlatform{t.CoreInfo, t.BoardPlatform, t.CorePlatform, t.VariantPlatform} {
+		if platform == nil {
+			continue
+		}
+		found := false
+		for _, p := range platforms {
+			found = found || p.Id == platform.Id
+		}
+		if !found {
+			platforms = append(platforms, platform)
+		}
+	}
+	return platforms
+}
+
+// findGitRepository returns the URL of the origin remote of the git repository in dir,
+// it's empty if dir is not a git repository, e.g. the library has not been installed with arduino-cli lib install --git-url
+func findGitRepository(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	content, err := paths.New(dir, ".git", "config").ReadFile()
+	if err != nil {
+		return ""
+	}
+	section := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = line
+		} else if key := strings.SplitN(line, "=", 2); section == `[remote "origin"]` && len(key) == 2 && strings.TrimSpace(key[0]) == "url" {
+			return strings.TrimSpace(key[1])
+		}
+	}
+	return ""
+}
+
+// cliConfig contains the settings of the arduino-cli used by arduino-cslt
+type cliConfig struct {
+	Directories struct {
+		// Data is the directory containing the indexes and the installed platforms
+		Data string `json:"data"`
+	} `json:"directories"`
+	BoardManager struct {
+		// AdditionalUrls contains the URLs of the package indexes of the third party cores
+		AdditionalUrls []string `json:"additional_urls"`
+	} `json:"board_manager"`
+}
+
+// readCliConfig returns the settings of the arduino-cli, as printed by arduino-cli config dump,
+// the ones in the config file of the compileOpts if specified
+func readCliConfig(ctx context.Context, compileOpts *CompileOptions) (*cliConfig, error) {
+	cmdArgs := []string{"config", "dump", "--format", "json"}
+	if compileOpts != nil && compileOpts.ConfigFile != "" {
+		cmdArgs = append(cmdArgs, "--config-file", compileOpts.ConfigFile)
+	}
+	logrus.Infof("running: arduino-cli %s", strings.Join(cmdArgs, " "))
+	cmdOutput, err := exec.CommandContext(ctx, "arduino-cli", cmdArgs...).Output()
+	if err != nil {
+		return nil, err
+	}
+	// the newer versions of the arduino-cli print the settings inside a config object
+	var config struct {
+		cliConfig
+		Config *cliConfig `json:"config"`
+	}
+	if err := json.Unmarshal(cmdOutput, &config); err != nil {
+		return nil, fmt.Errorf("cannot parse the arduino-cli config: %s", err)
+	}
+	if config.Config != nil {
+		return config.Config, nil
+	}
+	return &config.cliConfig, nil
+}
+
+// checkCli checks that the arduino-cli is installed and that its version is supported
+func checkCli(ctx context.Context) error {
+	cmdOutput, err := exec.CommandContext(ctx, "arduino-cli", "version", "--format", "json").Output()
+	if err != nil {
+		return &ToolNotFoundError{Tool: "arduino-cli", Err: err}
+	}
+	var unmarshalledOutput map[string]interface{}
+	json.Unmarshal(cmdOutput, &unmarshalledOutput)
+	currentCliVersion := fmt.Sprint(unmarshalledOutput["VersionString"])
+	return checkCliVersion(currentCliVersion)
+}
+
+// checkCliVersion will check if the version of the arduino-cli used is the correct one.
+// It will skip the check if the version comes from a non stable release
+// The version must be > 0.20.2
+func checkCliVersion(currentCliVersion string) error {
+	logrus.Infof("arduino-cli version: %s", currentCliVersion)
+	version, err := semver.Parse(currentCliVersion)
+	if err == nil {
+		// do the check
+		incompatibleVersion, _ := semver.Parse("0.20.2")
+		if version.LessThanOrEqual(incompatibleVersion) {
+			return &CliVersionError{Version: version.String(), IncompatibleUpTo: incompatibleVersion.String()}
+		}
+	} // we continue the execution, it means that the version could be one of:
+	// - git-snapshot - local build using task build
+	// - nightly-<date> - nightly build
+	// - test-<hash>-git-snapshot - tester builds generated by the CI system
+	return nil
+}
+
+// parseCliCompileOutput function takes fqbn and cmdOutToParse as argument,
+// cmdOutToParse is the json output captured from the command run
+// the function extracts and returns a Target object containing the paths of the .o files
+// (generated during the compile phase) and the informations regarding core and libraries used
+func parseCliCompileOutput(fqbn string, cmdOutToParse []byte) (*Target, error) {
+	var compileOutput cliCompileOutput
+	err := json.Unmarshal(cmdOutToParse, &compileOutput)
+	if err != nil {
+		return nil, &CompileError{Fqbn: fqbn, Err: err}
+	} else if !compileOutput.Success {
+		return nil, &CompileError{Fqbn: fqbn, CompilerErr: compileOutput.CompilerErr}
+	}
+
+	// this dir contains all the obj files we need (the sketch related ones and not the core or libs),
+	// the ones compiled from the src subfolder of the sketch are in the corresponding subfolders
+	sketchDir := paths.New(compileOutput.BuilderResult.BuildPath).Join("sketch")
+	sketchFilesPaths, err := sketchDir.ReadDirRecursive()
+	if err != nil {
+		return nil, err
+	}
+	sketchFilesPaths.FilterOutDirs()
+	sketchFilesPaths.FilterSuffix(sketchObjFileSuffixes...)
+	if len(sketchFilesPaths) == 0 {
+		return nil, fmt.Errorf("no object files in %s", sketchDir.String())
+	}
+
+	target := &Target{
+		Fqbn:         fqbn,
+		CoreInfo:     compileOutput.BuilderResult.BuildPlatform,
+		LibsInfo:     compileOutput.BuilderResult.UsedLibraries,
+		objFilesDir:  sketchDir,
+		objFilePaths: &sketchFilesPaths,
+	}
+	if match := precompiledCoreRegexp.FindStringSubmatch(compileOutput.CompilerOut); match != nil {
+		target.precompiledCorePath = paths.New(match[1])
+	}
+	return target, nil
+}
+
+// parseCliCompileOutputShowProp function takes fqbn and cmdOutToParse as argument,
+// cmdOutToParse is the output of the command run, containing a key=value line for every build property
+// the function returns the build properties, in the same order as printed.
+// The values are not expanded, the arduino-cli prints the {placeholders} as they are.
+// The lines that are not key=value (e.g. a notice of the arduino-cli) are logged and skipped
+func parseCliCompileOutputShowProp(fqbn string, cmdOutToParse []byte) (*properties, error) {
+	var lines []string
+	for _, line := range strings.Split(string(cmdOutToParse), "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") && !strings.Contains(trimmed, "=") {
+			logrus.Warnf("skipping %q in the build properties of %s, it's not a property", trimmed, fqbn)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	buildProperties, err := parseProperties([]byte(strings.Join(lines, "\n")))
+	if err != nil {
+		return nil, &CompileError{Fqbn: fqbn, Err: fmt.Errorf("cannot parse the build properties: %s", err)}
+	}
+	return buildProperties, nil
+}
+
+// precompiledFolder returns the folder, relative to the src folder of the library, where the arduino-cli looks for the precompiled archive.
+// It's the same logic used by the arduino-cli, see the library specification (https://arduino.github.io/arduino-cli/latest/library-specification/#precompiled-binaries):
+// the folder is {build.mcu}, or {build.mcu}/{fpu}-{float-abi} if the compiler is invoked with -mfpu and -mfloat-abi (e.g. cortex-m4/fpv4-sp-d16-hard).
+// The platforms not defining build.mcu get the src folder itself, that's where the arduino-cli looks for it in that case
+func precompiledFolder(buildProperties *properties) string {
+	mcu, _ := buildProperties.get("build.mcu")
+	recipe, _ := buildProperties.get("recipe.cpp.o.pattern")
+	compilerFlags := strings.Fields(buildProperties.expand(recipe))
+
+	var fpuSpecs []string
+	for _, flag := range []string{"-mfpu=", "-mfloat-abi="} {
+		for _, compilerFlag := range compilerFlags {
+			if strings.Contains(compilerFlag, flag) {
+				if spec := strings.SplitN(compilerFlag, "=", 2); spec[1] != "" {
+					fpuSpecs = append(fpuSpecs, strings.Trim(spec[1], `"'`))
+					break
+				}
+			}
+		}
+	}
+	if len(fpuSpecs) == 0 {
+		return mcu
+	}
+	return path.Join(mcu, strings.Join(fpuSpecs, "-"))
+}
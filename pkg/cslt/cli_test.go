@@ -0,0 +1,146 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+func TestParseCliCompileOutputShowProp(t *testing.T) {
+	output := "build.mcu=cortex-m4\r\n" +
+		"Downloading index: package_index.tar.bz2 downloaded\n" +
+		"compiler.path={runtime.tools.arm-none-eabi-gcc.path}/bin/\n" +
+		"\n" +
+		"# a comment\n" +
+		"build.extra_flags=-DFOO=1 -DBAR\n"
+	props, err := parseCliCompileOutputShowProp("arduino:mbed_nano:nano33ble", []byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(props.keys, ","); keys != "build.mcu,compiler.path,build.extra_flags" {
+		t.Errorf("keys are %s", keys)
+	}
+	for key, expected := range map[string]string{
+		"build.mcu":         "cortex-m4",
+		"compiler.path":     "{runtime.tools.arm-none-eabi-gcc.path}/bin/",
+		"build.extra_flags": "-DFOO=1 -DBAR",
+	} {
+		if value, _ := props.get(key); value != expected {
+			t.Errorf("%s is %q, expected %q", key, value, expected)
+		}
+	}
+}
+
+func TestPlatformOf(t *testing.T) {
+	dir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.RemoveAll()
+	avrDir := dir.Join("data", "packages", "arduino", "hardware", "avr", "1.8.6")
+	acmeDir := dir.Join("sketchbook", "hardware", "acme", "avr")
+	if err := acmeDir.MkdirAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := acmeDir.Join("platform.txt").WriteFile([]byte("name=Acme AVR\nversion=2.0.0\n")); err != nil {
+		t.Fatal(err)
+	}
+	coreInfo := &BuildPlatform{Id: "arduino:avr", Version: "1.8.6", InstallDir: avrDir.String()}
+
+	for _, test := range []struct {
+		name        string
+		properties  string
+		dirProperty string
+		subdir      string
+		expected    *BuildPlatform
+	}{
+		{"core of the build platform", "runtime.platform.path=" + avrDir.String() + "\nbuild.core.path={runtime.platform.path}/cores/arduino",
+			"build.core.path", "cores", coreInfo},
+		{"installed by the arduino-cli", "build.core.path=" + dir.Join("data", "packages", "MiniCore", "hardware", "avr", "2.1.3", "cores", "MCUdude_corefiles").String(),
+			"build.core.path", "cores", &BuildPlatform{Id: "MiniCore:avr", Version: "2.1.3", InstallDir: dir.Join("data", "packages", "MiniCore", "hardware", "avr", "2.1.3").String()}},
+		{"installed in the sketchbook", "build.variant.path=" + acmeDir.Join("variants", "uno").String(),
+			"build.variant.path", "variants", &BuildPlatform{Id: "acme:avr", Version: "2.0.0", InstallDir: acmeDir.String()}},
+		{"platform dir", "runtime.platform.path=" + acmeDir.String() + "/",
+			"runtime.platform.path", "", &BuildPlatform{Id: "acme:avr", Version: "2.0.0", InstallDir: acmeDir.String()}},
+		{"not in the subdir", "build.core.path=" + avrDir.Join("src", "arduino").String(), "build.core.path", "cores", nil},
+		{"not in a platform", "build.core.path=" + dir.Join("cores", "arduino").String(), "build.core.path", "cores", nil},
+		{"not set", "build.core.path=", "build.core.path", "cores", nil},
+		{"missing", "", "build.variant.path", "variants", nil},
+	} {
+		buildProperties, err := parseProperties([]byte(test.properties))
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := &Target{Fqbn: "arduino:avr:uno", CoreInfo: coreInfo, buildProperties: buildProperties}
+		platform := target.platformOf(test.dirProperty, test.subdir)
+		switch {
+		case test.expected == nil && platform != nil:
+			t.Errorf("%s: got %+v, expected nil", test.name, platform)
+		case test.expected == coreInfo && platform != coreInfo:
+			t.Errorf("%s: got %+v, expected the core info", test.name, platform)
+		case test.expected != nil && (platform == nil || *platform != *test.expected):
+			t.Errorf("%s: got %+v, expected %+v", test.name, platform, test.expected)
+		}
+	}
+}
+
+func TestCompileOptions(t *testing.T) {
+	all := &CompileOptions{
+		BuildProperties:  []string{"build.extra_flags=-DDEBUG=0 -DFOO", "compiler.c.extra_flags=-fno-lto"},
+		BoardOptions:     []string{"cpu=atmega328old", "speed=115200"},
+		OptimizeForDebug: true,
+		Libraries:        []string{"/libs", "/other libs"},
+		Library:          []string{"/path/MyLib", "/path/Other"},
+		ConfigFile:       "/home/user/arduino-cli.yaml",
+		Warnings:         "all",
+	}
+	for _, test := range []struct {
+		name         string
+		opts         *CompileOptions
+		fqbn         string
+		expectedFqbn string
+		args         []string
+		recordedArgs []string
+		commandLine  string
+	}{
+		{"nil", nil, "arduino:avr:nano", "arduino:avr:nano", nil, nil, ""},
+		{"empty", &CompileOptions{}, "arduino:avr:nano", "arduino:avr:nano", nil, nil, ""},
+		{"all", all, "arduino:avr:nano", "arduino:avr:nano:cpu=atmega328old,speed=115200",
+			[]string{"--build-property", "build.extra_flags=-DDEBUG=0 -DFOO", "--build-property", "compiler.c.extra_flags=-fno-lto", "--optimize-for-debug",
+				"--libraries", "/libs,/other libs", "--library", "/path/MyLib", "--library", "/path/Other", "--config-file", "/home/user/arduino-cli.yaml", "--warnings", "all"},
+			[]string{"--build-property", "build.extra_flags=-DDEBUG=0 -DFOO", "--build-property", "compiler.c.extra_flags=-fno-lto", "--optimize-for-debug"},
+			"--build-property 'build.extra_flags=-DDEBUG=0 -DFOO' --build-property compiler.c.extra_flags=-fno-lto --optimize-for-debug"},
+		// the fqbn already contains some options
+		{"fqbn with options", &CompileOptions{BoardOptions: []string{"speed=115200"}}, "arduino:avr:nano:cpu=atmega328old", "arduino:avr:nano:cpu=atmega328old,speed=115200", nil, nil, ""},
+		{"quotes", &CompileOptions{BuildProperties: []string{`build.extra_flags=-DNAME="it's"`}}, "arduino:avr:uno", "arduino:avr:uno",
+			[]string{"--build-property", `build.extra_flags=-DNAME="it's"`}, []string{"--build-property", `build.extra_flags=-DNAME="it's"`},
+			`--build-property 'build.extra_flags=-DNAME="it'\''s"'`},
+		{"local only", &CompileOptions{Library: []string{"/path/MyLib"}, Warnings: "none"}, "arduino:avr:uno", "arduino:avr:uno",
+			[]string{"--library", "/path/MyLib", "--warnings", "none"}, nil, ""},
+	} {
+		if fqbn := test.opts.fqbn(test.fqbn); fqbn != test.expectedFqbn {
+			t.Errorf("%s: fqbn is %s, expected %s", test.name, fqbn, test.expectedFqbn)
+		}
+		if args := test.opts.args(); strings.Join(args, "|") != strings.Join(test.args, "|") {
+			t.Errorf("%s: args are %q, expected %q", test.name, args, test.args)
+		}
+		if args := test.opts.recordedArgs(); strings.Join(args, "|") != strings.Join(test.recordedArgs, "|") {
+			t.Errorf("%s: recorded args are %q, expected %q", test.name, args, test.recordedArgs)
+		}
+		if commandLine := test.opts.commandLine(); commandLine != test.commandLine {
+			t.Errorf("%s: command line is %s, expected %s", test.name, commandLine, test.commandLine)
+		}
+	}
+
+	if recorded := all.recorded(); recorded == nil || recorded.Library != nil || recorded.ConfigFile != "" || len(recorded.BoardOptions) != 2 {
+		t.Errorf("the recorded options are %+v", recorded)
+	}
+	if recorded := (&CompileOptions{Library: []string{"/path/MyLib"}}).recorded(); recorded != nil {
+		t.Errorf("the local options are recorded: %+v", recorded)
+	}
+}
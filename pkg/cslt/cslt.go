@@ -0,0 +1,387 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+
+// Package cslt uses the Arduino CLI to compile an Arduino sketch into a precompiled library,
+// together with the informations regarding the core and libraries required to link it again.
+package cslt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// UsedLibrary contains information regarding the library used during the compile process,
+// the fields are the ones reported by the arduino-cli, with the same names
+type UsedLibrary struct {
+	Name             string   `json:"name"`
+	Version          string   `json:"version"`
+	ProvidesIncludes []string `json:"provides_includes"`
+	// License is the license declared in the library.properties of the library,
+	// or the one found in its license files (e.g. LICENSE.txt) if not declared
+	License string `json:"license,omitempty"`
+	// Location tells where the library is installed, e.g. in the user sketchbook or bundled with the platform
+	Location LibraryLocation `json:"location,omitempty"`
+	// InstallDir is the directory where the library is installed
+	InstallDir string `json:"install_dir,omitempty"`
+	// SourceDir is the directory containing the sources of the library, e.g. its src folder
+	SourceDir string `json:"source_dir,omitempty"`
+	// ContainerPlatform is the platform containing the library, if it's bundled with a platform
+	ContainerPlatform string `json:"container_platform,omitempty"`
+	// Repository is the URL of the git repository the library comes from, if known: it's the origin remote of its install dir
+	Repository    string   `json:"repository,omitempty"`
+	Architectures []string `json:"architectures,omitempty"`
+	Types         []string `json:"types,omitempty"`
+	Author        string   `json:"author,omitempty"`
+	Maintainer    string   `json:"maintainer,omitempty"`
+	Sentence      string   `json:"sentence,omitempty"`
+	Website       string   `json:"website,omitempty"`
+	Category      string   `json:"category,omitempty"`
+}
+
+// LibraryLocation tells where a library is installed
+type LibraryLocation string
+
+const (
+	// LibraryLocationIdeBuiltin is a library bundled with the Arduino IDE
+	LibraryLocationIdeBuiltin LibraryLocation = "ide"
+	// LibraryLocationUser is a library installed in the user sketchbook, e.g. with arduino-cli lib install
+	LibraryLocationUser LibraryLocation = "user"
+	// LibraryLocationPlatformBuiltin is a library bundled with the platform of the board
+	LibraryLocationPlatformBuiltin LibraryLocation = "platform"
+	// LibraryLocationReferencedPlatformBuiltin is a library bundled with the platform referenced by the board, e.g. the core of another vendor
+	LibraryLocationReferencedPlatformBuiltin LibraryLocation = "ref-platform"
+	// LibraryLocationUnmanaged is a library specified with the --library flag of the arduino-cli
+	LibraryLocationUnmanaged LibraryLocation = "unmanaged"
+)
+
+// libraryLocations contains the locations in the order of the values of the LibraryLocation enum of the arduino-cli gRPC API
+var libraryLocations = []LibraryLocation{
+	LibraryLocationIdeBuiltin,
+	LibraryLocationUser,
+	LibraryLocationPlatformBuiltin,
+	LibraryLocationReferencedPlatformBuiltin,
+	LibraryLocationUnmanaged,
+}
+
+// UnmarshalJSON reads the location as printed by the different versions of the arduino-cli:
+// its name (e.g. "user" or "LIBRARY_LOCATION_USER") or the value of the gRPC enum (e.g. 1)
+func (l *LibraryLocation) UnmarshalJSON(data []byte) error {
+	var index int
+	if err := json.Unmarshal(data, &index); err == nil {
+		if index < 0 || index >= len(libraryLocations) {
+			return fmt.Errorf("unknown library location %d", index)
+		}
+		*l = libraryLocations[index]
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	name = strings.ToLower(strings.TrimPrefix(name, "LIBRARY_LOCATION_"))
+	switch name {
+	case "ide_builtin":
+		*l = LibraryLocationIdeBuiltin
+	case "platform_builtin":
+		*l = LibraryLocationPlatformBuiltin
+	case "referenced_platform_builtin":
+		*l = LibraryLocationReferencedPlatformBuiltin
+	default:
+		*l = LibraryLocation(name)
+	}
+	return nil
+}
+
+// BuildPlatform contains information regarding the platform used during the compile process
+type BuildPlatform struct {
+	Id      string `json:"id"`
+	Version string `json:"version"`
+	// License is the license found in the license files of the platform (e.g. LICENSE.txt), if any
+	License string `json:"license,omitempty"`
+	// InstallDir is the directory where the platform is installed, for the build platform it's the one containing {build.core.path}
+	InstallDir string `json:"install_dir,omitempty"`
+	// IndexUrl is the URL of the package index listing the platform, it's empty for the Arduino cores, that don't need it
+	IndexUrl string `json:"index_url,omitempty"`
+}
+
+// CompileOptions contains the options passed to the arduino-cli compile command, they have the same meaning of its flags.
+// The ones changing the binary are recorded in result.json, to compile the sketch again in the same way:
+// the other ones contain local paths or only change the messages of the compiler
+type CompileOptions struct {
+	// BuildProperties override the build properties of the board, e.g. "build.extra_flags=-DDEBUG=0"
+	BuildProperties []string `json:"buildProperties,omitempty"`
+	// BoardOptions contains the options of the board, e.g. "cpu=atmega328old", they are added to the fqbn
+	BoardOptions []string `json:"boardOptions,omitempty"`
+	// OptimizeForDebug compiles the sketch with the debug optimizations of the platform
+	OptimizeForDebug bool `json:"optimizeForDebug,omitempty"`
+	// Libraries contains directories containing libraries, the libraries used are recorded in libsInfo
+	Libraries []string `json:"-"`
+	// Library contains the paths of single libraries, the libraries used are recorded in libsInfo
+	Library []string `json:"-"`
+	// ConfigFile is the arduino-cli config file to use, it's used to read the arduino-cli settings too
+	ConfigFile string `json:"-"`
+	// Warnings is the level of the warnings printed by the compiler: none, default, more or all
+	Warnings string `json:"-"`
+}
+
+// ResultJson contains information regarding the core and libraries used during the compile process of every target
+type ResultJson struct {
+	Targets []*Target `json:"targets"`
+	// PublicHeaders contains the headers of the sketch exported by the library, relative to its src folder
+	PublicHeaders []string `json:"publicHeaders,omitempty"`
+}
+
+// Target contains information regarding the core and libraries used to compile the sketch for a single board
+type Target struct {
+	Fqbn     string `json:"fqbn"`
+	BuildMcu string `json:"buildMcu"`
+	// BuildBoard is {build.board}, the builder defines the ARDUINO_{build.board} macro when compiling for the board
+	BuildBoard string `json:"buildBoard,omitempty"`
+	// PrecompiledFolder is the folder containing the archive, relative to the src folder of the library:
+	// {build.mcu}, or {build.mcu}/{fpu}-{float-abi} for the boards with a hardware FPU
+	PrecompiledFolder string         `json:"precompiledFolder"`
+	CoreInfo          *BuildPlatform `json:"coreInfo"`
+	// BoardPlatform, CorePlatform and VariantPlatform are the platforms defining the board, providing the core and the variant:
+	// they are different when the board uses the core or the variant of another platform (e.g. build.core=arduino:arduino)
+	BoardPlatform   *BuildPlatform `json:"boardPlatform,omitempty"`
+	CorePlatform    *BuildPlatform `json:"corePlatform,omitempty"`
+	VariantPlatform *BuildPlatform `json:"variantPlatform,omitempty"`
+	LibsInfo        []*UsedLibrary `json:"libsInfo"`
+	// CompileOptions contains the options, affecting the binary, used to compile the sketch for the board
+	CompileOptions *CompileOptions `json:"compileOptions,omitempty"`
+	// Firmware describes the binary linked during the precompilation, it's used to verify the library
+	Firmware *Firmware `json:"firmware,omitempty"`
+	// objFilesDir is the directory containing the sketch related object files, also in its subdirectories
+	objFilesDir *paths.Path
+	// objFilePaths contains the paths to the sketch related object files produced during the compile phase
+	objFilePaths *paths.PathList
+	// buildProperties contains the build properties used to compile the sketch for the board
+	buildProperties *properties
+	// precompiledCorePath is the archive of the core built by a previous compilation, if the arduino-cli used it
+	precompiledCorePath *paths.Path
+}
+
+// Options contains the parameters of Precompile
+type Options struct {
+	// SketchPath is the path of the sketch to precompile, it can be the sketch directory or its main .ino file
+	SketchPath string
+	// Fqbns contains the Fully Qualified Board Names of the boards to compile the sketch for,
+	// every board produces its own archive inside the same precompiled library
+	Fqbns []string
+	// OutputDir is the directory where the precompiled library is created, it defaults to sketch-dist in the current working directory
+	OutputDir string
+	// Overwrite tells what to do if OutputDir already exists
+	Overwrite OverwritePolicy
+	// Strip removes the debug sections from the archived object files
+	Strip bool
+	// Localize makes every symbol of the archived object files local, except _setup, _loop and Exports:
+	// the object files are linked in a single relocatable object, this way the sketch code can still reference itself
+	Localize bool
+	// Exports contains the symbols kept global by Localize, e.g. the functions declared by the PublicHeaders.
+	// C++ functions can be specified by name (e.g. configure or config::init), every overload is kept
+	Exports []string
+	// PublicHeaders contains the patterns of the sketch headers exported by the library, e.g. "api.h" or "src/api/*.h".
+	// The patterns use the path.Match syntax and are matched against the slash separated paths relative to the sketch directory.
+	// The headers are copied in the src folder of the library, keeping their path, and included by lib<sketch>.h
+	PublicHeaders []string
+	// Deterministic makes the output reproducible: building the same sketch twice gives the same files, byte for byte.
+	// The sketch is staged in a fixed directory, because its path ends up in the object files, so only one deterministic run
+	// at a time is possible for a sketch. The archives are written like `ar D` does, with the members sorted by name,
+	// and all the output files get the same mode and the modification time in SOURCE_DATE_EPOCH (or the Unix epoch)
+	Deterministic bool
+	// Package creates a package of the output directory in the given format, next to it (e.g. sketch-dist.zip).
+	// It follows the Overwrite policy of the output directory, but when merging the package is replaced
+	Package PackageFormat
+	// SignKey, if not nil, is used to write a detached signature of the files of the library and of the sketch, see VerifySignatures.
+	// When merging the signatures of the archives already in the library are replaced too
+	SignKey ed25519.PrivateKey
+	// SBOM creates a Software Bill of Materials in the given format, in the extras folder of the library (e.g. sbom.spdx.json).
+	// It describes the precompiled library, the cores and the libraries used, with the licenses they declare
+	SBOM SBOMFormat
+	// AdditionalUrls contains the URLs of the package indexes of third party cores, they are used together with the ones
+	// in the arduino-cli config to find where the core of every board comes from. Only the indexes already downloaded are read
+	AdditionalUrls []string
+	// LicensePolicy, if not nil, is checked against the licenses of the cores and of the libraries used, also the ones of the
+	// boards already in the library when merging: a denied license makes Precompile fail before the library is created
+	LicensePolicy *LicensePolicy
+	// CompileOptions, if not nil, are passed to every arduino-cli compile command run
+	CompileOptions *CompileOptions
+	// LibraryProperties contains the metadata of the precompiled library, the empty fields get their default value
+	// but Author is required: Precompile fails if it's nil or Author is empty.
+	// They are not used, nor required, when merging with an existing library: its library.properties is kept
+	LibraryProperties *LibraryProperties
+}
+
+// OverwritePolicy tells Precompile what to do if the output directory already exists
+type OverwritePolicy int
+
+const (
+	// OverwriteFail makes Precompile fail, before compiling, if the output directory already exists
+	OverwriteFail OverwritePolicy = iota
+	// OverwriteReplace replaces the output directory, the previous one is restored if Precompile fails.
+	// The directory must be empty or contain the output of a previous run
+	OverwriteReplace
+	// OverwriteMerge adds the archives of the new boards to the precompiled library of the same sketch in the output directory,
+	// result.json, the header and the README.md are updated to contain both the old and the new boards
+	OverwriteMerge
+)
+
+// Result contains the outcome of Precompile
+type Result struct {
+	// OutputDir is the directory containing the precompiled library, the sketch and the README.md
+	OutputDir *paths.Path
+	// ArchivePaths contains the paths of the archives of the library, in the same order of ResultJson.Targets.
+	// With OverwriteMerge it includes the archives of the boards that were already in the library
+	ArchivePaths paths.PathList
+	// ResultJson is the content of the result.json saved in the extras directory of the library
+	ResultJson *ResultJson
+	// GeneratedFiles contains the paths of all the files inside OutputDir at the end of the run,
+	// with OverwriteMerge it includes the ones of the previous runs that were kept
+	GeneratedFiles paths.PathList
+	// PackagePath is the path of the package of OutputDir, if requested
+	PackagePath *paths.Path
+}
+
+// Precompile compiles the sketch producing a precompiled library, following opts.
+// The user's sketch directory is never written to: the sketch is patched and compiled in a temporary staging directory.
+// Everything done after the sketch has been found is part of a transaction:
+// if an error occurs, or ctx is canceled, every file and directory created is removed.
+// The errors returned are one of the error types defined in this package, when the cause is known.
+func Precompile(ctx context.Context, opts Options) (res *Result, err error) {
+	if len(opts.Fqbns) == 0 {
+		return nil, &InvalidOptionsError{Reason: "at least one fqbn is required"}
+	}
+
+	// let's check the arduino-cli version
+	if err := checkCli(ctx); err != nil {
+		return nil, err
+	}
+	if err := opts.CompileOptions.validate(); err != nil {
+		return nil, err
+	}
+	// the settings are used to find where the cores and the libraries come from
+	config, err := readCliConfig(ctx, opts.CompileOptions)
+	if err != nil {
+		logrus.Warnf("cannot read the arduino-cli config: %s", err)
+		config = &cliConfig{}
+	}
+
+	// check if the path of the sketch is valid and get the path of the main sketch.ino (in case the sketch dir is specified)
+	inoPath, err := getInoSketchPath(opts.SketchPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sketchName := strings.TrimSuffix(inoPath.Base(), inoPath.Ext())
+	if opts.LicensePolicy != nil {
+		if err := opts.LicensePolicy.validate(); err != nil {
+			return nil, &InvalidOptionsError{Reason: "invalid license policy: " + err.Error()}
+		}
+	}
+
+	// the output directory is checked before compiling, it's pointless to compile if the result cannot be saved
+	output, err := getOutputDir(opts, sketchName, inoPath.Parent())
+	if err != nil {
+		return nil, err
+	}
+
+	// the library metadata are validated before compiling too, unless the library.properties of an existing library is kept
+	libProps := &LibraryProperties{}
+	if opts.LibraryProperties != nil {
+		libProps = opts.LibraryProperties
+	}
+	libProps = libProps.withDefaults(sketchName)
+	if output.overwrite == OverwriteMerge && output.path.Exist() {
+		if opts.LibraryProperties != nil && *opts.LibraryProperties != (LibraryProperties{}) {
+			logrus.Warnf("merging with %s, the library metadata specified are ignored: its library.properties is kept", output.path.String())
+		}
+	} else if err := libProps.validate(); err != nil {
+		return nil, err
+	}
+
+	// the journal is written before touching anything, this way an interrupted run can be recovered
+	tx, err := beginTransaction(inoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// a panic must roll back the transaction too, otherwise the partial output would be committed
+		if r := recover(); r != nil {
+			tx.end(ctx, fmt.Errorf("panic: %v", r))
+			panic(r)
+		}
+		if err = tx.end(ctx, err); err != nil {
+			res = nil
+		}
+	}()
+
+	// copy the sketch in a private staging directory, the user's sketch directory is never written to
+	stagingDir, err := createStagingDir(tx, sketchName, opts.Deterministic)
+	if err != nil {
+		return nil, err
+	}
+	stagedInoPath, err := stageSketch(inoPath, stagingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// create a main.cpp file in the same dir of the staged sketch.ino
+	if err := createMainCpp(stagedInoPath); err != nil {
+		return nil, err
+	}
+
+	// replace setup() with _setup() and loop() with _loop() in the staged sketch.ino file
+	if err := patchSketch(stagedInoPath); err != nil {
+		return nil, &SketchError{Path: inoPath.String(), Err: err}
+	}
+
+	// the public headers are taken from the staged sketch, this way they match the compiled sources
+	publicHeaders, err := findPublicHeaders(stagedInoPath.Parent(), opts.PublicHeaders, sketchName)
+	if err != nil {
+		return nil, err
+	}
+
+	// let's compile the sketch for every board, each one will produce an archive in its own precompiled folder (e.g. {build.mcu})
+	var targets []*Target
+	indexes := newPackageIndexes(config, opts.AdditionalUrls)
+	for _, fqbn := range opts.Fqbns {
+		target, err := compileTarget(ctx, fqbn, stagedInoPath, stagingDir, opts.CompileOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, platform := range target.platforms() {
+			platform.IndexUrl = indexes.indexUrl(platform.Id)
+		}
+		// the debug informations and the symbols of the sketch would reveal its internals, they can be removed using the platform toolchain
+		if err := hideObjects(ctx, target, sketchName, opts.Strip, opts.Localize, opts.Exports); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// nothing is created if the library would link a core or a library with a denied license
+	if err := checkLicensePolicy(opts.LicensePolicy, append(append([]*Target{}, output.targets...), targets...)); err != nil {
+		return nil, err
+	}
+
+	// let's create the library corresponding to the precompiled sketch
+	lib := &library{
+		sketchName:    sketchName,
+		properties:    libProps,
+		sketchDir:     stagedInoPath.Parent(),
+		publicHeaders: publicHeaders,
+		libraryIndex:  readLibraryIndex(config),
+	}
+	return createLib(tx, lib, output, targets)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLibraryLocationUnmarshalJSON(t *testing.T) {
+	for _, test := range []struct {
+		json     string
+		expected LibraryLocation
+		err      bool
+	}{
+		// the values of the gRPC enum
+		{`0`, LibraryLocationIdeBuiltin, false},
+		{`1`, LibraryLocationUser, false},
+		{`2`, LibraryLocationPlatformBuiltin, false},
+		{`3`, LibraryLocationReferencedPlatformBuiltin, false},
+		{`4`, LibraryLocationUnmanaged, false},
+		{`5`, "", true},
+		{`-1`, "", true},
+		// the names of the gRPC enum
+		{`"LIBRARY_LOCATION_IDE_BUILTIN"`, LibraryLocationIdeBuiltin, false},
+		{`"LIBRARY_LOCATION_USER"`, LibraryLocationUser, false},
+		{`"LIBRARY_LOCATION_PLATFORM_BUILTIN"`, LibraryLocationPlatformBuiltin, false},
+		{`"LIBRARY_LOCATION_REFERENCED_PLATFORM_BUILTIN"`, LibraryLocationReferencedPlatformBuiltin, false},
+		{`"LIBRARY_LOCATION_UNMANAGED"`, LibraryLocationUnmanaged, false},
+		// the lowercase names, printed by the arduino-cli and written in result.json
+		{`"ide_builtin"`, LibraryLocationIdeBuiltin, false},
+		{`"user"`, LibraryLocationUser, false},
+		{`"platform"`, LibraryLocationPlatformBuiltin, false},
+		{`"ref-platform"`, LibraryLocationReferencedPlatformBuiltin, false},
+		{`"Unmanaged"`, LibraryLocationUnmanaged, false},
+		{`true`, "", true},
+	} {
+		var lib UsedLibrary
+		err := json.Unmarshal([]byte(`{"name":"Foo","location":`+test.json+`}`), &lib)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.json, lib.Location)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.json, err)
+		} else if lib.Location != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.json, lib.Location, test.expected)
+		}
+	}
+
+	// the location is written with its name, so result.json can be read again
+	content, _ := json.Marshal(&UsedLibrary{Name: "Foo", Location: LibraryLocationReferencedPlatformBuiltin})
+	var lib UsedLibrary
+	if err := json.Unmarshal(content, &lib); err != nil || lib.Location != LibraryLocationReferencedPlatformBuiltin {
+		t.Errorf("%s read as %q: %v", content, lib.Location, err)
+	}
+}
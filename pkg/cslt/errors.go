@@ -0,0 +1,192 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InvalidOptionsError is returned when the Options passed to Precompile are not valid
+type InvalidOptionsError struct {
+	Reason string
+}
+
+func (e *InvalidOptionsError) Error() string {
+	return "invalid options: " + e.Reason
+}
+
+// ToolNotFoundError is returned when a tool required to precompile the sketch cannot be run
+type ToolNotFoundError struct {
+	Tool string
+	Err  error
+}
+
+func (e *ToolNotFoundError) Error() string {
+	return fmt.Sprintf("cannot run %s, be sure to have it installed in your $PATH: %s", e.Tool, e.Err)
+}
+
+func (e *ToolNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// CliVersionError is returned when the version of the arduino-cli installed is not supported
+type CliVersionError struct {
+	Version          string
+	IncompatibleUpTo string
+}
+
+func (e *CliVersionError) Error() string {
+	return fmt.Sprintf("please use a version > %s of the arduino-cli, installed version: %s", e.IncompatibleUpTo, e.Version)
+}
+
+// SketchError is returned when the sketch cannot be found or it's not valid
+type SketchError struct {
+	Path string
+	Err  error
+}
+
+func (e *SketchError) Error() string {
+	return fmt.Sprintf("invalid sketch %s: %s", e.Path, e.Err)
+}
+
+func (e *SketchError) Unwrap() error {
+	return e.Err
+}
+
+// CompileError is returned when the arduino-cli fails to compile the sketch
+type CompileError struct {
+	Fqbn string
+	// CompilerErr is the error output of the compiler, if available
+	CompilerErr string
+	Err         error
+}
+
+func (e *CompileError) Error() string {
+	if e.CompilerErr != "" {
+		return fmt.Sprintf("sketch compile was not successful for %s: %s", e.Fqbn, e.CompilerErr)
+	}
+	return fmt.Sprintf("sketch compile was not successful for %s: %s", e.Fqbn, e.Err)
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// BuildPropertyError is returned when a build property required to create the library is missing
+type BuildPropertyError struct {
+	Fqbn     string
+	Property string
+}
+
+func (e *BuildPropertyError) Error() string {
+	return fmt.Sprintf("cannot find %q in arduino-cli output for %s", e.Property, e.Fqbn)
+}
+
+// TargetConflictError is returned when two boards would produce their archives in the same directory
+type TargetConflictError struct {
+	Fqbn      string
+	OtherFqbn string
+	// PrecompiledFolder is the folder shared by the two boards, relative to the src folder of the library
+	PrecompiledFolder string
+}
+
+func (e *TargetConflictError) Error() string {
+	return fmt.Sprintf("%s and %s both use the precompiled folder src/%s, only one of them can be included in the library", e.OtherFqbn, e.Fqbn, e.PrecompiledFolder)
+}
+
+// LtoObjectsError is returned when the objects of the sketch have to be stripped or localized, but they are compiled with -flto:
+// they contain the intermediate representation of the code, that cannot be processed by objcopy
+type LtoObjectsError struct {
+	Fqbn string
+}
+
+func (e *LtoObjectsError) Error() string {
+	return fmt.Sprintf("the sketch objects for %s are compiled with -flto, their intermediate representation cannot be stripped or localized", e.Fqbn)
+}
+
+// LibraryPropertyError is returned when a value of the LibraryProperties is not valid
+type LibraryPropertyError struct {
+	Property string
+	Value    string
+	Reason   string
+}
+
+func (e *LibraryPropertyError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("invalid library property %s: %s", e.Property, e.Reason)
+	}
+	return fmt.Sprintf("invalid library property %s=%q: %s", e.Property, e.Value, e.Reason)
+}
+
+// LicensePolicyError is returned when the license policy file is not valid
+type LicensePolicyError struct {
+	Path   string
+	Reason string
+}
+
+func (e *LicensePolicyError) Error() string {
+	return fmt.Sprintf("invalid license policy %s: %s", e.Path, e.Reason)
+}
+
+// LicenseDeniedError is returned when a core or a library used by the sketch has a license denied by the LicensePolicy
+type LicenseDeniedError struct {
+	// Denied contains a description of every core and library denied
+	Denied []string
+}
+
+func (e *LicenseDeniedError) Error() string {
+	return "the license policy denies " + strings.Join(e.Denied, "; ")
+}
+
+// OutputExistsError is returned when the output directory already exists and the OverwritePolicy is OverwriteFail
+type OutputExistsError struct {
+	Path string
+}
+
+func (e *OutputExistsError) Error() string {
+	return fmt.Sprintf("%s already exists", e.Path)
+}
+
+// KeyError is returned when a signing or verification key cannot be read
+type KeyError struct {
+	Path string
+	Err  error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("invalid key %s: %s", e.Path, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// InterruptedError is returned when the context passed to Precompile is canceled, e.g. by a termination signal
+type InterruptedError struct {
+	Err error
+}
+
+func (e *InterruptedError) Error() string {
+	return "interrupted: " + e.Err.Error()
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// DistError is returned when the directory to verify is not a valid output of Precompile
+type DistError struct {
+	Path string
+	Err  error
+}
+
+func (e *DistError) Error() string {
+	return fmt.Sprintf("invalid precompiled sketch %s: %s", e.Path, e.Err)
+}
+
+func (e *DistError) Unwrap() error {
+	return e.Err
+}
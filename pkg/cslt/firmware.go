@@ -0,0 +1,94 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// Firmware contains information regarding the binary linked by the arduino-cli, it's used to check that the
+// precompiled library links again into the same firmware
+type Firmware struct {
+	// Sha256 is the hash of the content of the sections loaded in the board memory, in address order
+	Sha256 string `json:"sha256"`
+	// Sections contains the sections that occupy the board memory, in address order
+	Sections []*FirmwareSection `json:"sections"`
+}
+
+// FirmwareSection contains the name and the size of a section of the firmware
+type FirmwareSection struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+// readFirmware reads the ELF firmware in elfPath and returns the corresponding Firmware.
+// Only the sections allocated in the board memory are considered, the debug ones don't end up in the board
+// and they contain the paths of the build directory, that are different every time.
+func readFirmware(elfPath *paths.Path) (*Firmware, error) {
+	elfFile, err := elf.Open(elfPath.String())
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the firmware %s: %s", elfPath.String(), err)
+	}
+	defer elfFile.Close()
+
+	var sections []*elf.Section
+	for _, section := range elfFile.Sections {
+		if section.Flags&elf.SHF_ALLOC != 0 && section.Size > 0 {
+			sections = append(sections, section)
+		}
+	}
+	sort.SliceStable(sections, func(i, j int) bool { return sections[i].Addr < sections[j].Addr })
+
+	hash := sha256.New()
+	firmware := &Firmware{}
+	for _, section := range sections {
+		firmware.Sections = append(firmware.Sections, &FirmwareSection{Name: section.Name, Size: section.Size})
+		// .bss has no content, and the notes are metadata: e.g. the GNU build-id is calculated on the debug sections too
+		if section.Type == elf.SHT_NOBITS || section.Type == elf.SHT_NOTE {
+			continue
+		}
+		content, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read section %s of %s: %s", section.Name, elfPath.String(), err)
+		}
+		hash.Write(content)
+	}
+	firmware.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return firmware, nil
+}
+
+// compareFirmwares returns a description of every difference in the sections of the expected and the actual firmware,
+// the differences are empty if they match. A different hash is only a warning: the reference firmware is linked from the loose objects
+// of the sketch, while the precompiled library is an archive, so the linker can place the same code in a different order
+func compareFirmwares(expected, actual *Firmware) (differences []string, warnings []string) {
+	actualSizes := map[string]uint64{}
+	for _, section := range actual.Sections {
+		actualSizes[section.Name] = section.Size
+	}
+	expectedSizes := map[string]uint64{}
+	for _, section := range expected.Sections {
+		expectedSizes[section.Name] = section.Size
+		if size, ok := actualSizes[section.Name]; !ok {
+			differences = append(differences, fmt.Sprintf("section %s is missing", section.Name))
+		} else if size != section.Size {
+			differences = append(differences, fmt.Sprintf("section %s size is %d bytes, expected %d (%+d)", section.Name, size, section.Size, int64(size)-int64(section.Size)))
+		}
+	}
+	for _, section := range actual.Sections {
+		if _, ok := expectedSizes[section.Name]; !ok {
+			differences = append(differences, fmt.Sprintf("section %s is not expected (%d bytes)", section.Name, section.Size))
+		}
+	}
+	if expected.Sha256 != actual.Sha256 {
+		warnings = append(warnings, fmt.Sprintf("sha256 is %s, expected %s", actual.Sha256, expected.Sha256))
+	}
+	return differences, warnings
+}
@@ -0,0 +1,47 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareFirmwares(t *testing.T) {
+	firmware := func(sha256 string, sections ...*FirmwareSection) *Firmware {
+		return &Firmware{Sha256: sha256, Sections: sections}
+	}
+	text := &FirmwareSection{Name: ".text", Size: 10240}
+	data := &FirmwareSection{Name: ".data", Size: 256}
+	bss := &FirmwareSection{Name: ".bss", Size: 2048}
+	expected := firmware("aaaa", text, data, bss)
+
+	for _, test := range []struct {
+		name        string
+		actual      *Firmware
+		differences []string
+		warnings    []string
+	}{
+		{"same", firmware("aaaa", text, data, bss), nil, nil},
+		// the sections are compared by name, the order could be different
+		{"different order", firmware("aaaa", data, text, bss), nil, nil},
+		{"different hash", firmware("bbbb", text, data, bss), nil, []string{"sha256 is bbbb, expected aaaa"}},
+		{"missing section", firmware("aaaa", text, bss), []string{"section .data is missing"}, nil},
+		{"extra section", firmware("aaaa", text, data, bss, &FirmwareSection{Name: ".noinit", Size: 16}),
+			[]string{"section .noinit is not expected (16 bytes)"}, nil},
+		{"bigger section", firmware("bbbb", &FirmwareSection{Name: ".text", Size: 10300}, data, bss),
+			[]string{"section .text size is 10300 bytes, expected 10240 (+60)"}, []string{"sha256 is bbbb, expected aaaa"}},
+		{"smaller section", firmware("aaaa", text, data, &FirmwareSection{Name: ".bss", Size: 2000}),
+			[]string{"section .bss size is 2000 bytes, expected 2048 (-48)"}, nil},
+	} {
+		differences, warnings := compareFirmwares(expected, test.actual)
+		if !reflect.DeepEqual(differences, test.differences) {
+			t.Errorf("%s: got differences %q, expected %q", test.name, differences, test.differences)
+		}
+		if !reflect.DeepEqual(warnings, test.warnings) {
+			t.Errorf("%s: got warnings %q, expected %q", test.name, warnings, test.warnings)
+		}
+	}
+}
@@ -0,0 +1,741 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// library describes the content of the precompiled library to create
+type library struct {
+	// sketchName is the name of the sketch without the .ino extension, the library is named lib{sketchName}
+	sketchName string
+	// properties contains the metadata written in library.properties, already validated
+	properties *LibraryProperties
+	// sketchDir is the directory of the sketch containing the public headers
+	sketchDir *paths.Path
+	// publicHeaders contains the slash separated paths of the headers exported by the library, relative to sketchDir
+	publicHeaders []string
+	// libraryIndex contains the libraries of the Library Manager, the README.md tells how to install the other ones
+	libraryIndex *libraryIndex
+}
+
+// outputDir is the directory where the precompiled library is created
+type outputDir struct {
+	path      *paths.Path
+	overwrite OverwritePolicy
+	// targets contains the targets already precompiled in path, the new targets are merged with them
+	targets []*Target
+	// publicHeaders contains the headers already exported by the library in path
+	publicHeaders []string
+	// deterministic tells to create the same output, byte for byte, from the same object files
+	deterministic bool
+	// packageFormat is the format of the package of path to create, if any
+	packageFormat PackageFormat
+	// signKey is the key used to sign the library, if any
+	signKey ed25519.PrivateKey
+	// sbomFormat is the format of the SBOM of the library to create, if any
+	sbomFormat SBOMFormat
+}
+
+// getOutputDir returns the output directory specified in opts, it fails if the directory cannot be written following opts.Overwrite:
+// when replacing, the directory must be empty or contain the output of a previous run, when merging the precompiled library of the same sketch.
+// The directory can never contain the sketch in sketchDir or the working directory, they would be replaced
+func getOutputDir(opts Options, sketchName string, sketchDir *paths.Path) (*outputDir, error) {
+	output := &outputDir{overwrite: opts.Overwrite, deterministic: opts.Deterministic, packageFormat: opts.Package, signKey: opts.SignKey, sbomFormat: opts.SBOM}
+	workingDir, err := paths.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if opts.OutputDir == "" {
+		output.path = workingDir.Join("sketch-dist")
+	} else {
+		absOutputDir, err := paths.New(opts.OutputDir).Abs()
+		if err != nil {
+			return nil, err
+		}
+		output.path = absOutputDir
+	}
+	for _, dir := range []struct {
+		description string
+		path        *paths.Path
+	}{{"the sketch directory", sketchDir}, {"the working directory", workingDir}} {
+		canonicalOutputDir, canonicalDir := output.path.Canonical(), dir.path.Canonical()
+		if inside, _ := canonicalDir.IsInsideDir(canonicalOutputDir); inside || canonicalDir.EqualsTo(canonicalOutputDir) {
+			return nil, &InvalidOptionsError{Reason: fmt.Sprintf("the output directory %s contains %s %s", output.path, dir.description, canonicalDir)}
+		}
+	}
+
+	switch opts.Package {
+	case PackageNone, PackageZip, PackageTarGz:
+	default:
+		return nil, &InvalidOptionsError{Reason: fmt.Sprintf("unknown package format %q, it must be %s or %s", opts.Package, PackageZip, PackageTarGz)}
+	}
+	switch opts.SBOM {
+	case SBOMNone, SBOMSpdx, SBOMCycloneDX:
+	default:
+		return nil, &InvalidOptionsError{Reason: fmt.Sprintf("unknown SBOM format %q, it must be %s or %s", opts.SBOM, SBOMSpdx, SBOMCycloneDX)}
+	}
+	if opts.Package != PackageNone && opts.Overwrite == OverwriteFail {
+		if pkgPath := packagePath(output.path, opts.Package); pkgPath.Exist() {
+			return nil, &OutputExistsError{Path: pkgPath.String()}
+		}
+	}
+
+	if output.path.NotExist() {
+		return output, nil
+	}
+	switch opts.Overwrite {
+	case OverwriteReplace:
+		// only the output of a previous run is replaced, any other directory could contain the user's data
+		if files, err := output.path.ReadDir(); err == nil && len(files) == 0 {
+			return output, nil
+		}
+		if _, _, _, err := readDist(output.path); err != nil && !errors.Is(err, errLegacyResultJson) {
+			return nil, &DistError{Path: output.path.String(), Err: fmt.Errorf("only the output of a previous run can be replaced: %s", err)}
+		}
+		return output, nil
+	case OverwriteMerge:
+		libDir, _, resultJson, err := readDist(output.path)
+		if err != nil {
+			return nil, &DistError{Path: output.path.String(), Err: err}
+		} else if libDir.Base() != "lib"+sketchName {
+			return nil, &DistError{Path: output.path.String(), Err: fmt.Errorf("it contains %s, not lib%s", libDir.Base(), sketchName)}
+		}
+		output.targets = resultJson.Targets
+		output.publicHeaders = resultJson.PublicHeaders
+		return output, nil
+	default:
+		return nil, &OutputExistsError{Path: output.path.String()}
+	}
+}
+
+// createLib function will take care of creating the library directory structure and files required, for the precompiled library to be recognized as such.
+// lib contains the name of the sketch, used for the name of the lib, the metadata and the public headers of the library.
+// output is the directory where the library is created, if it already exists it's replaced or merged following its overwrite policy.
+// targets contains a Target for every board we have compiled for. The library specifications (https://arduino.github.io/arduino-cli/0.20/library-specification/#precompiled-binaries) requires that the precompiled archive is stored inside a folder with the name of the MCU used during the compile,
+// so every target will have its own folder. Each Target contains the fqbn, required in order to generate the README.md file with instructions,
+// the informations regarding core and libraries used during the compile process and the paths to all the sketch related object files produced during the compile phase.
+// The files and directories created are added to the transaction tx, this way they are removed if something goes wrong,
+// the ones overwritten are moved aside and restored.
+// It returns a Result describing what has been created.
+func createLib(tx *transaction, lib *library, output *outputDir, targets []*Target) (*Result, error) {
+	// we are going to leverage the precompiled library infrastructure to make the linking work.
+	// this type of lib, as the type suggest, is already compiled so it only gets linked during the linking phase of a sketch
+	// but we have to create a library folder structure in the output directory:
+
+	// sketch-dist/
+	// ├── libsketch
+	// │   ├── extras
+	// │   │   └── result.json
+	// │   ├── library.properties
+	// │   └── src
+	// │       ├── cortex-m0plus
+	// │       │   └── libsketch.a
+	// │       ├── cortex-m4
+	// │       │   └── fpv4-sp-d16-hard  <-- boards with a hardware FPU have a subfolder named {fpu}-{float-abi}
+	// │       │       └── libsketch.a
+	// │       ├── api.h  <-- the public headers of the sketch, if any
+	// │       └── libsketch.h
+	// ├── README.md  <--contains information regarding libraries and core to install in order to reproduce the original build environment
+	// ├── THIRD_PARTY_LICENSES  <-- the licenses of the libraries and core, with the texts found in their license files
+	// └── sketch
+	//     └── sketch.ino  <-- the actual sketch we are going to compile with the arduino-cli later
+
+	// two boards sharing the same precompiled folder (e.g. the same {build.mcu}) would end up overwriting the same archive
+	allTargets := append(append([]*Target{}, output.targets...), targets...)
+	folderFqbns := map[string]string{}
+	for _, target := range allTargets {
+		if otherFqbn, ok := folderFqbns[target.PrecompiledFolder]; ok {
+			return nil, &TargetConflictError{Fqbn: target.Fqbn, OtherFqbn: otherFqbn, PrecompiledFolder: target.PrecompiledFolder}
+		}
+		folderFqbns[target.PrecompiledFolder] = target.Fqbn
+	}
+
+	publicHeaders := append([]string{}, output.publicHeaders...)
+	for _, header := range lib.publicHeaders {
+		publicHeaders = appendIfMissing(publicHeaders, header)
+	}
+
+	var err error
+	sketchName := lib.sketchName
+	rootDir := output.path
+	libDir := rootDir.Join("lib" + sketchName)
+	srcDir := libDir.Join("src")
+	sketchDir := rootDir.Join(sketchName)
+	extraDir := libDir.Join("extras")
+	libsketchHeaderPath := srcDir.Join("lib" + sketchName + ".h")
+	sketchFilePath := sketchDir.Join(sketchName + ".ino")
+	readmeMdPath := rootDir.Join("README.md")
+	thirdPartyLicensesPath := rootDir.Join(thirdPartyLicensesFileName)
+	resultJsonPath := extraDir.Join("result.json")
+
+	// when merging only the files describing all the targets are rewritten, otherwise the whole directory is created from scratch
+	merge := output.overwrite == OverwriteMerge && rootDir.Exist()
+	if rootDir.Exist() {
+		// the backups are kept next to the output directory: they are moved there, so they must be on the same filesystem
+		backupDir, err := paths.MkTempDir(rootDir.Parent().String(), ".arduino-cslt-backup-")
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.addTemporary(backupDir); err != nil {
+			return nil, err
+		}
+		if !merge {
+			if err = tx.moveAside(rootDir, backupDir); err != nil {
+				return nil, err
+			}
+		} else {
+			for _, path := range []*paths.Path{libsketchHeaderPath, readmeMdPath, resultJsonPath, thirdPartyLicensesPath} {
+				// the libraries created by older versions don't contain all the files
+				if path.NotExist() {
+					continue
+				}
+				if err = tx.moveAside(path, backupDir); err != nil {
+					return nil, err
+				}
+			}
+			// the signatures of the files rewritten (result.json, the header and the SBOM) are not valid anymore,
+			// the other ones are replaced only if a new key is available
+			rewritten := paths.PathList{resultJsonPath, libsketchHeaderPath}
+			if output.sbomFormat != SBOMNone {
+				rewritten.Add(sbomPath(extraDir, output.sbomFormat))
+			}
+			for _, path := range signedFiles(libDir, output.targets, output.publicHeaders, output.sbomFormat) {
+				sigPath := signaturePath(path)
+				if sigPath.NotExist() {
+					continue
+				} else if output.signKey == nil && !rewritten.Contains(path) {
+					logrus.Warnf("%s is signed, but the new archives are not", path.String())
+					continue
+				}
+				if err = tx.moveAside(sigPath, backupDir); err != nil {
+					return nil, err
+				}
+			}
+			for _, format := range sbomFormats {
+				if path := sbomPath(extraDir, format); format == output.sbomFormat && path.Exist() {
+					if err = tx.moveAside(path, backupDir); err != nil {
+						return nil, err
+					}
+				} else if path.Exist() {
+					logrus.Warnf("%s is not updated, it doesn't describe the new boards", path.String())
+				}
+			}
+		}
+	}
+
+	if merge {
+		// the files that are not moved aside are new, e.g. the older versions didn't write THIRD_PARTY_LICENSES or the signatures
+		newFiles := paths.PathList{libsketchHeaderPath, readmeMdPath, resultJsonPath, thirdPartyLicensesPath}
+		if output.sbomFormat != SBOMNone {
+			newFiles.Add(sbomPath(extraDir, output.sbomFormat))
+		}
+		if output.signKey != nil {
+			for _, path := range signedFiles(libDir, allTargets, publicHeaders, output.sbomFormat) {
+				newFiles.Add(signaturePath(path))
+			}
+		}
+		for _, path := range newFiles {
+			if path.NotExist() {
+				if err = tx.addCreated(path); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if !merge {
+		// let's create the dir structure, the missing parents of rootDir (e.g. -o a/b/sketch-dist) are removed on rollback too
+		if err = tx.addCreated(firstMissing(rootDir)); err != nil {
+			return nil, err
+		}
+		if err = rootDir.MkdirAll(); err != nil {
+			return nil, err
+		}
+		if err = libDir.Mkdir(); err != nil {
+			return nil, err
+		}
+		if err = srcDir.Mkdir(); err != nil {
+			return nil, err
+		}
+		if err = sketchDir.MkdirAll(); err != nil {
+			return nil, err
+		}
+		if err = extraDir.Mkdir(); err != nil {
+			return nil, err
+		}
+
+		// let's create the files
+
+		if err = createLibraryPropertiesFile(lib.properties, libDir); err != nil {
+			return nil, err
+		}
+
+		if err = createSketchFile(sketchName, sketchFilePath); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = copyPublicHeaders(tx, lib, srcDir, merge); err != nil {
+		return nil, err
+	}
+
+	if err = createLibSketchHeaderFile(libsketchHeaderPath, allTargets, publicHeaders); err != nil {
+		return nil, err
+	}
+
+	if err = createReadmeMdFile(sketchFilePath, libDir, readmeMdPath, allTargets, lib.libraryIndex); err != nil {
+		return nil, err
+	}
+
+	if err = createThirdPartyLicensesFile(thirdPartyLicensesPath, allTargets); err != nil {
+		return nil, err
+	}
+
+	res := &Result{
+		OutputDir:  rootDir,
+		ResultJson: &ResultJson{Targets: allTargets, PublicHeaders: publicHeaders},
+	}
+	// the archives of the boards already in the output directory come first, like in allTargets
+	for _, target := range output.targets {
+		res.ArchivePaths.Add(srcDir.Join(target.PrecompiledFolder, "lib"+sketchName+".a"))
+	}
+	for _, target := range targets {
+		precompiledDir := srcDir.Join(target.PrecompiledFolder)
+		// the folder could already exist when merging, e.g. src/cortex-m4/ containing fpv4-sp-d16-hard/,
+		// so the new archive is journaled even if its folder isn't new
+		if archivePath := precompiledDir.Join("lib" + sketchName + ".a"); merge && archivePath.NotExist() {
+			if err = tx.addCreated(firstMissing(archivePath)); err != nil {
+				return nil, err
+			}
+		}
+		if err = precompiledDir.MkdirAll(); err != nil {
+			return nil, err
+		}
+		archivePath, err := createArchiveFile(sketchName, target.objFilesDir, target.objFilePaths, precompiledDir, output.deterministic)
+		if err != nil {
+			return nil, err
+		}
+		res.ArchivePaths.Add(archivePath)
+	}
+
+	if err = createResultJsonFile(resultJsonPath, res.ResultJson); err != nil {
+		return nil, err
+	}
+
+	if output.sbomFormat != SBOMNone {
+		// when merging the metadata of the library are the ones already in its library.properties
+		libProps := lib.properties
+		if merge {
+			if libProps, err = loadLibraryProperties(libDir.Join("library.properties").String(), true); err != nil {
+				return nil, err
+			}
+		}
+		created := time.Now()
+		if output.deterministic {
+			created = deterministicTime()
+		}
+		if err = createSbomFile(sbomPath(extraDir, output.sbomFormat), output.sbomFormat, libProps, allTargets, created); err != nil {
+			return nil, err
+		}
+	}
+
+	if output.signKey != nil {
+		if err = signFiles(signedFiles(libDir, allTargets, publicHeaders, output.sbomFormat), output.signKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if output.deterministic {
+		if err = normalizeFiles(rootDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if res.GeneratedFiles, err = rootDir.ReadDirRecursive(); err != nil {
+		return nil, err
+	}
+	res.GeneratedFiles.FilterOutDirs()
+
+	if output.packageFormat != PackageNone {
+		if res.PackagePath, err = createPackage(tx, rootDir, libDir, output.packageFormat, output.deterministic); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// normalizeFiles sets the same mode and modification time to all the files and directories in rootDir, rootDir included:
+// the directories are 0755 and the files 0644, the modification time is the one of deterministicTime.
+// This way the output doesn't depend on the umask or on when it's been built, e.g. when it's packaged
+func normalizeFiles(rootDir *paths.Path) error {
+	mtime := deterministicTime()
+	files, err := rootDir.ReadDirRecursive()
+	if err != nil {
+		return err
+	}
+	files.Add(rootDir)
+	for _, file := range files {
+		mode := os.FileMode(0644)
+		if file.IsDir() {
+			mode = 0755
+		}
+		if err := os.Chmod(file.String(), mode); err != nil {
+			return err
+		}
+		if err := file.Chtimes(mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deterministicTime returns the time used in place of the current one by the deterministic mode:
+// it's the one in the SOURCE_DATE_EPOCH environment variable (https://reproducible-builds.org/specs/source-date-epoch/), or the Unix epoch
+func deterministicTime() time.Time {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC()
+	}
+	return time.Unix(0, 0).UTC()
+}
+
+// firstMissing returns the outermost directory missing in the path, it's the one to remove to remove path.
+// Only the first directory missing is added to a transaction, the ones inside it are removed together with it
+func firstMissing(path *paths.Path) *paths.Path {
+	for path.Parent().NotExist() {
+		path = path.Parent()
+	}
+	return path
+}
+
+// copyPublicHeaders copies the public headers of lib in srcDir, keeping their path relative to the sketch directory.
+// When merging, the headers already in the library are kept, but they must be the same of the sketch
+func copyPublicHeaders(tx *transaction, lib *library, srcDir *paths.Path, merge bool) error {
+	for _, header := range lib.publicHeaders {
+		content, err := lib.sketchDir.Join(header).ReadFile()
+		if err != nil {
+			return err
+		}
+		headerPath := srcDir.Join(header)
+		if headerPath.Exist() {
+			libContent, err := headerPath.ReadFile()
+			if err != nil {
+				return err
+			} else if !bytes.Equal(content, libContent) {
+				return &DistError{Path: srcDir.Parent().Parent().String(), Err: fmt.Errorf("the public header %s of the library differs from the one of the sketch", header)}
+			}
+			continue
+		}
+		if merge {
+			if err := tx.addCreated(firstMissing(headerPath)); err != nil {
+				return err
+			}
+		}
+		if err := headerPath.Parent().MkdirAll(); err != nil {
+			return err
+		}
+		if err := createFile(headerPath, string(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// libraryInstallInstructions returns the lines of the README.md telling how to install the libraries used by target, grouped by location:
+// the ones available in the Library Manager are installed with a single command, the ones installed from a git repository
+// with --git-url, while for the other ones (e.g. specified with --library) only some guidance can be given.
+// The libraries bundled with a platform are installed together with it, they are only listed
+func libraryInstallInstructions(target *Target, index *libraryIndex) []string {
+	var managed, instructions, bundled []string
+	for _, lib := range target.LibsInfo {
+		release := lib.Name + "@" + lib.Version
+		switch {
+		case lib.Location == LibraryLocationPlatformBuiltin || lib.Location == LibraryLocationReferencedPlatformBuiltin:
+			bundled = append(bundled, "`"+release+"`")
+		case lib.Location == LibraryLocationUnmanaged:
+			instructions = append(instructions, fmt.Sprintf("`%s` has been specified with `--library`, add `--library <path of %s>` to the compile command", release, lib.Name))
+		case lib.Repository != "":
+			instructions = append(instructions, fmt.Sprintf("`arduino-cli lib install --git-url %s` to install `%s`, it requires `arduino-cli config set library.enable_unsafe_install true`", lib.Repository, release))
+		case !index.contains(lib.Name, lib.Version):
+			instructions = append(instructions, fmt.Sprintf("`%s` is not available in the Library Manager: install it with `arduino-cli lib install --zip-path <%s.zip>`, it requires `arduino-cli config set library.enable_unsafe_install true`, or add `--library <path of %s>` to the compile command", release, lib.Name, lib.Name))
+		default:
+			// the names can contain spaces, e.g. "Adafruit GFX Library"
+			if strings.Contains(release, " ") {
+				release = `"` + release + `"`
+			}
+			managed = append(managed, release)
+		}
+	}
+
+	var lines []string
+	if len(managed) > 0 {
+		lines = append(lines, "`arduino-cli lib install "+strings.Join(managed, " ")+"`")
+	}
+	lines = append(lines, instructions...)
+	if len(bundled) == 1 {
+		lines = append(lines, bundled[0]+" is bundled with the core and installed together with it")
+	} else if len(bundled) > 1 {
+		lines = append(lines, strings.Join(bundled, ", ")+" are bundled with the core and installed together with it")
+	}
+	return lines
+}
+
+// createLibraryPropertiesFile will create a library.properties file in the libDir,
+// libProps contains the metadata of the "library", the name is the one of the sketch unless specified otherwise
+func createLibraryPropertiesFile(libProps *LibraryProperties, libDir *paths.Path) error {
+	// the library.properties contains the following:
+	var libraryProperties []string
+	fields := libProps.fields()
+	for _, key := range libraryPropertiesKeys {
+		if value := *fields[key]; value != "" || key == "paragraph" {
+			libraryProperties = append(libraryProperties, key+"="+value)
+		}
+	}
+	libraryProperties = append(libraryProperties, "precompiled=true")
+
+	libraryPropertyPath := libDir.Join("library.properties")
+	return createFile(libraryPropertyPath, strings.Join(libraryProperties, "\n"))
+}
+
+// createLibSketchHeaderFile will create the libsketch header file in libsketchHeaderPath
+// This file has predeclarations of _setup() and _loop() functions declared originally in the main.cpp file (which is not included in the .a archive),
+// It is the counterpart of libsketch.a
+// we pass the targets because from there we can extract infos regarding used libs
+// publicHeaders are included after the libraries, this way they can use them
+func createLibSketchHeaderFile(libsketchHeaderPath *paths.Path, targets []*Target, publicHeaders []string) error {
+	// we calculate the #include part to append at the beginning of the header file here with all the libraries used by the original sketch.
+	// A library could be used only by some of the targets (e.g. it's architecture specific), in that case the #include is guarded
+	// using the ARDUINO_ARCH_{build.arch} macro defined by the builder, if all the targets of the architecture use it,
+	// otherwise the ARDUINO_{build.board} macro of every target using it
+	var includes []string
+	includeTargets := map[string][]*Target{}
+	for _, target := range targets {
+		for _, lib := range target.LibsInfo {
+			for _, include := range lib.ProvidesIncludes {
+				if _, ok := includeTargets[include]; !ok {
+					includes = append(includes, include)
+				}
+				if !containsTarget(includeTargets[include], target) {
+					includeTargets[include] = append(includeTargets[include], target)
+				}
+			}
+		}
+	}
+	archTargets := map[string]int{}
+	for _, target := range targets {
+		archTargets[target.arch()]++
+	}
+
+	var librariesIncludes []string
+	for _, include := range includes {
+		users := includeTargets[include]
+		if len(users) == len(targets) {
+			librariesIncludes = append(librariesIncludes, "#include \""+include+"\"")
+			continue
+		}
+		usersArchs := map[string]int{}
+		for _, target := range users {
+			usersArchs[target.arch()]++
+		}
+		var conditions []string
+		for _, target := range users {
+			var condition string
+			if usersArchs[target.arch()] == archTargets[target.arch()] {
+				condition = "defined(ARDUINO_ARCH_" + strings.ToUpper(target.arch()) + ")"
+			} else if target.BuildBoard != "" {
+				condition = "defined(ARDUINO_" + target.BuildBoard + ")"
+			} else {
+				// the result.json written by older versions doesn't contain build.board
+				logrus.Warnf("%s is not used by all the %s boards, but the macro of %s is unknown: it's included for all of them", include, target.arch(), target.Fqbn)
+				condition = "defined(ARDUINO_ARCH_" + strings.ToUpper(target.arch()) + ")"
+			}
+			conditions = appendIfMissing(conditions, condition)
+		}
+		librariesIncludes = append(librariesIncludes,
+			"#if "+strings.Join(conditions, " || "),
+			"#include \""+include+"\"",
+			"#endif")
+	}
+
+	for _, header := range publicHeaders {
+		librariesIncludes = append(librariesIncludes, "#include \""+header+"\"")
+	}
+
+	// the libsketch.h contains the following:
+	libsketchHeader := strings.Join(librariesIncludes, "\n") + `
+void _setup();
+void _loop();`
+
+	return createFile(libsketchHeaderPath, libsketchHeader)
+}
+
+// containsTarget is an helper function that returns true if target is in targets
+func containsTarget(targets []*Target, target *Target) bool {
+	for _, t := range targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// appendIfMissing is an helper function that appends value to values only if it's not already there
+func appendIfMissing(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// arch returns the architecture of the board the target has been compiled for, it's the second field of the fqbn
+func (t *Target) arch() string {
+	if fqbnParts := strings.Split(t.Fqbn, ":"); len(fqbnParts) > 1 {
+		return fqbnParts[1]
+	}
+	return ""
+}
+
+// createSketchFile will create the sketch which will be the entrypoint of the compilation with the arduino-cli
+// the sketch file will be created in sketchFilePath
+// the sketchName argument is used to correctly include the right .h file
+func createSketchFile(sketchName string, sketchFilePath *paths.Path) error {
+	// This one will include the libsketch.h and basically is the replacement of main.cpp
+	// the sketch.ino contains the following:
+	sketchFile := `#include <` + "lib" + sketchName + `.h>
+void setup() {
+  _setup();
+}
+void loop() {
+  _loop();
+}`
+	return createFile(sketchFilePath, sketchFile)
+}
+
+// createReadmeMdFile is a helper function that is reposnible for the generation of the README.md file containing informations on how to reproduce the build environment
+// it takes the targets and some paths.Paths as input to do the required calculations.. The name of the arguments should be sufficient to understand
+func createReadmeMdFile(sketchFilePath, libDir, readmeMdPath *paths.Path, targets []*Target, index *libraryIndex) error {
+	// make the paths relative to the directory of the README.md, the only ones valid wherever the output is copied
+	sketchFileRelPath, err := sketchFilePath.RelFrom(readmeMdPath.Parent())
+	if err != nil {
+		return err
+	}
+	libRelDir, err := libDir.RelFrom(readmeMdPath.Parent())
+	if err != nil {
+		return err
+	}
+
+	// generate the commands to run to successfully reproduce the build environment, they will be used as content for the README.md
+	var readmeContent []string
+	var readmeCompile []string
+	for _, target := range targets {
+		readmeContent = append(readmeContent, "### "+target.Fqbn)
+		// the board can use the core or the variant of other platforms, they must be installed too
+		for _, platform := range target.platforms() {
+			coreInstall := "arduino-cli core install " + platform.Id
+			if platform.Version != "" {
+				coreInstall += "@" + platform.Version
+			}
+			if platform.IndexUrl != "" {
+				coreInstall += " --additional-urls " + platform.IndexUrl
+			}
+			readmeContent = append(readmeContent, "`"+coreInstall+"`")
+		}
+		readmeContent = append(readmeContent, libraryInstallInstructions(target, index)...)
+		// the options changing the binary are needed to link the same firmware
+		compileCmd := "arduino-cli compile -b " + target.CompileOptions.fqbn(target.Fqbn) + " " + sketchFileRelPath.String() + " --library " + libRelDir.String()
+		if options := target.CompileOptions.commandLine(); options != "" {
+			compileCmd += " " + options
+		}
+		readmeCompile = append(readmeCompile, "`"+compileCmd+"`")
+	}
+
+	//create the README.md file containig instructions regarding what commands to run in order to have again a working binary
+	// the README.md contains the following:
+	readmeMd := `This package contains firmware code loaded in your product. 
+` + licensingParagraph(targets) + `
+
+## Install core and libraries
+` + strings.Join(readmeContent, "\n") + "\n" + `
+## Compile
+Run from the directory containing this README.md:
+` + strings.Join(readmeCompile, "\n") + "\n"
+
+	return createFile(readmeMdPath, readmeMd)
+}
+
+// createArchiveFile function will create an archive containing all the object files except the one of mainCppFileName (we don't need it because we have created a substitute of it before: sketchfile.ino)
+// objFilesDir is the directory containing the object files, it's used to give a unique name to the ones with the same name in different subdirectories.
+// the archive is created inside precompiledDir and its path is returned, if deterministic is true it only depends on the object files content
+func createArchiveFile(sketchName string, objFilesDir *paths.Path, objFilePaths *paths.PathList, precompiledDir *paths.Path, deterministic bool) (*paths.Path, error) {
+	// we exclude the main.cpp.o because we are going to link the archive libsketch.a against sketchName.ino
+	mainCppObjFilePath := objFilesDir.Join(mainCppFileName + ".o")
+	var archivedFilePaths paths.PathList
+	var objFilesRelPaths []string
+	for _, objFilePath := range *objFilePaths {
+		if objFilePath.EqualsTo(mainCppObjFilePath) {
+			continue
+		}
+		objFileRelPath, err := objFilePath.RelFrom(objFilesDir)
+		if err != nil {
+			return nil, err
+		}
+		archivedFilePaths.Add(objFilePath)
+		objFilesRelPaths = append(objFilesRelPaths, filepath.ToSlash(objFileRelPath.String()))
+	}
+
+	var members []*archiveMember
+	for i, name := range uniqueMemberNames(objFilesRelPaths) {
+		member, err := newArchiveMember(name, archivedFilePaths[i])
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	archivePath := precompiledDir.Join("lib" + sketchName + ".a")
+	if err := writeArchive(archivePath, members, deterministic); err != nil {
+		return nil, err
+	}
+	logrus.Infof("created %s", archivePath.String())
+	return archivePath, nil
+}
+
+// createResultJsonFile will generate the result.json file and save it in jsonFilePath, inside the library extra dir
+func createResultJsonFile(jsonFilePath *paths.Path, returnJson *ResultJson) error {
+	if jsonContents, err := json.MarshalIndent(returnJson, "", " "); err != nil {
+		return fmt.Errorf("error serializing json: %s", err)
+	} else if err := jsonFilePath.WriteFile(jsonContents); err != nil {
+		return fmt.Errorf("error writing %s: %s", jsonFilePath.Base(), err)
+	}
+	logrus.Infof("created %s", jsonFilePath.String())
+	return nil
+}
+
+// createFile is an helper function useful to create a file,
+// it takes filePath and fileContent as arguments,
+// filePath points to the location where to save the file
+// fileContent include the content of the file
+func createFile(filePath *paths.Path, fileContent string) error {
+	err := os.WriteFile(filePath.String(), []byte(fileContent), 0644)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("created %s", filePath.String())
+	return nil
+}
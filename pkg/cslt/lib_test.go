@@ -0,0 +1,195 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+func TestLibraryInstallInstructions(t *testing.T) {
+	index := &libraryIndex{releases: map[string]bool{"WiFiNINA@1.8.13": true, "Adafruit GFX Library@1.11.3": true, "Servo@1.1.8": true}}
+	wifi := &UsedLibrary{Name: "WiFiNINA", Version: "1.8.13", Location: LibraryLocationUser}
+	gfx := &UsedLibrary{Name: "Adafruit GFX Library", Version: "1.11.3", Location: LibraryLocationUser}
+	spi := &UsedLibrary{Name: "SPI", Version: "1.0", Location: LibraryLocationPlatformBuiltin}
+	wire := &UsedLibrary{Name: "Wire", Version: "1.0", Location: LibraryLocationReferencedPlatformBuiltin}
+	local := &UsedLibrary{Name: "MyLib", Version: "0.1.0", Location: LibraryLocationUnmanaged}
+	git := &UsedLibrary{Name: "Servo", Version: "1.1.8", Location: LibraryLocationUser, Repository: "https://github.com/arduino-libraries/Servo.git"}
+	missing := &UsedLibrary{Name: "Private", Version: "2.0.0", Location: LibraryLocationUser}
+	oldVersion := &UsedLibrary{Name: "WiFiNINA", Version: "1.0.0", Location: LibraryLocationUser}
+
+	for _, test := range []struct {
+		name     string
+		libs     []*UsedLibrary
+		index    *libraryIndex
+		expected []string
+	}{
+		{"none", nil, index, nil},
+		{"managed", []*UsedLibrary{wifi, gfx}, index, []string{"`arduino-cli lib install WiFiNINA@1.8.13 \"Adafruit GFX Library@1.11.3\"`"}},
+		{"bundled", []*UsedLibrary{spi}, index, []string{"`SPI@1.0` is bundled with the core and installed together with it"}},
+		{"bundled with the referenced platform", []*UsedLibrary{spi, wire}, index, []string{"`SPI@1.0`, `Wire@1.0` are bundled with the core and installed together with it"}},
+		{"unmanaged", []*UsedLibrary{local}, index, []string{"`MyLib@0.1.0` has been specified with `--library`, add `--library <path of MyLib>` to the compile command"}},
+		// the repository wins over the Library Manager
+		{"git", []*UsedLibrary{git}, index, []string{"`arduino-cli lib install --git-url https://github.com/arduino-libraries/Servo.git` to install `Servo@1.1.8`, it requires `arduino-cli config set library.enable_unsafe_install true`"}},
+		{"not in the index", []*UsedLibrary{missing, oldVersion}, index, []string{
+			"`Private@2.0.0` is not available in the Library Manager: install it with `arduino-cli lib install --zip-path <Private.zip>`, it requires `arduino-cli config set library.enable_unsafe_install true`, or add `--library <path of Private>` to the compile command",
+			"`WiFiNINA@1.0.0` is not available in the Library Manager: install it with `arduino-cli lib install --zip-path <WiFiNINA.zip>`, it requires `arduino-cli config set library.enable_unsafe_install true`, or add `--library <path of WiFiNINA>` to the compile command",
+		}},
+		// without the index every library is assumed to be in the Library Manager
+		{"no index", []*UsedLibrary{missing}, nil, []string{"`arduino-cli lib install Private@2.0.0`"}},
+		{"sorted by kind", []*UsedLibrary{spi, local, wifi}, index, []string{
+			"`arduino-cli lib install WiFiNINA@1.8.13`",
+			"`MyLib@0.1.0` has been specified with `--library`, add `--library <path of MyLib>` to the compile command",
+			"`SPI@1.0` is bundled with the core and installed together with it",
+		}},
+	} {
+		lines := libraryInstallInstructions(&Target{LibsInfo: test.libs}, test.index)
+		if strings.Join(lines, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, strings.Join(lines, "\n"), strings.Join(test.expected, "\n"))
+		}
+	}
+}
+
+func TestGetOutputDir(t *testing.T) {
+	tmpDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpDir.RemoveAll()
+	// the working directory is used by the default output directory, and it can never be replaced
+	workingDir := tmpDir.Join("work")
+	for name, content := range map[string]string{
+		"work/sketch/sketch.ino":                        "void setup() {}\nvoid loop() {}\n",
+		"work/previous/libsketch/extras/result.json":    `{"targets":[{"fqbn":"arduino:samd:mkr1000","precompiledFolder":"cortex-m0plus"}],"publicHeaders":["api.h"]}`,
+		"work/previous/sketch/sketch.ino":               "",
+		"work/other/libother/extras/result.json":        `{"targets":[{"fqbn":"arduino:samd:mkr1000","precompiledFolder":"cortex-m0plus"}]}`,
+		"work/other/other/other.ino":                    "",
+		"work/data/notes.txt":                           "",
+		"work/legacy/libsketch/extras/result.json":      `{"coreInfo":{"id":"arduino:samd"}}`,
+		"work/legacy/sketch/sketch.ino":                 "",
+		"work/sketch-dist/libsketch/extras/result.json": `{"targets":[{"fqbn":"arduino:samd:mkr1000","precompiledFolder":"cortex-m0plus"}]}`,
+		"work/sketch-dist/sketch/sketch.ino":            "",
+	} {
+		path := tmpDir.Join(name)
+		if err := path.Parent().MkdirAll(); err != nil {
+			t.Fatal(err)
+		}
+		if err := path.WriteFile([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := workingDir.Join("empty").Mkdir(); err != nil {
+		t.Fatal(err)
+	}
+	previousWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(previousWd)
+	if err := os.Chdir(workingDir.String()); err != nil {
+		t.Fatal(err)
+	}
+	sketchDir := workingDir.Join("sketch")
+
+	for _, test := range []struct {
+		name      string
+		outputDir string
+		overwrite OverwritePolicy
+		errType   string // the type of the error expected, empty if the output directory can be used
+		targets   int    // the targets already in the output directory
+	}{
+		{"new directory", "new", OverwriteFail, "", 0},
+		{"default directory", "", OverwriteFail, "*cslt.OutputExistsError", 0},
+		{"existing directory", "previous", OverwriteFail, "*cslt.OutputExistsError", 0},
+		{"replace a new directory", "new", OverwriteReplace, "", 0},
+		{"replace an empty directory", "empty", OverwriteReplace, "", 0},
+		{"replace a previous output", "previous", OverwriteReplace, "", 0},
+		{"replace a legacy output", "legacy", OverwriteReplace, "", 0},
+		{"replace the user's data", "data", OverwriteReplace, "*cslt.DistError", 0},
+		{"merge in a new directory", "new", OverwriteMerge, "", 0},
+		{"merge with a previous output", "previous", OverwriteMerge, "", 1},
+		{"merge with another sketch", "other", OverwriteMerge, "*cslt.DistError", 0},
+		{"merge with a legacy output", "legacy", OverwriteMerge, "*cslt.DistError", 0},
+		{"merge with the user's data", "data", OverwriteMerge, "*cslt.DistError", 0},
+		{"working directory", ".", OverwriteReplace, "*cslt.InvalidOptionsError", 0},
+		{"parent of the working directory", "..", OverwriteMerge, "*cslt.InvalidOptionsError", 0},
+		{"sketch directory", "sketch", OverwriteReplace, "*cslt.InvalidOptionsError", 0},
+	} {
+		output, err := getOutputDir(Options{OutputDir: test.outputDir, Overwrite: test.overwrite}, "sketch", sketchDir)
+		if test.errType != "" {
+			if errType := fmt.Sprintf("%T", err); errType != test.errType {
+				t.Errorf("%s: got error %v (%s), expected %s", test.name, err, errType, test.errType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		expected := workingDir.Join("sketch-dist")
+		if test.outputDir != "" {
+			expected = workingDir.Join(test.outputDir)
+		}
+		if !output.path.EquivalentTo(expected) {
+			t.Errorf("%s: got %s, expected %s", test.name, output.path, expected)
+		}
+		if len(output.targets) != test.targets {
+			t.Errorf("%s: got %d targets, expected %d", test.name, len(output.targets), test.targets)
+		}
+	}
+}
+
+func TestCreateLibSketchHeaderFile(t *testing.T) {
+	tmpDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpDir.RemoveAll()
+	lib := func(include string) *UsedLibrary {
+		return &UsedLibrary{Name: strings.TrimSuffix(include, ".h"), ProvidesIncludes: []string{include}}
+	}
+	spi, wire, wifi101, wifiNina, servo := lib("SPI.h"), lib("Wire.h"), lib("WiFi101.h"), lib("WiFiNINA.h"), lib("Servo.h")
+	targets := []*Target{
+		{Fqbn: "arduino:samd:mkr1000", BuildBoard: "SAMD_MKR1000", LibsInfo: []*UsedLibrary{spi, wifi101}},
+		{Fqbn: "arduino:samd:mkrwifi1010", BuildBoard: "SAMD_MKRWIFI1010", LibsInfo: []*UsedLibrary{spi, wifiNina, wire}},
+		{Fqbn: "arduino:mbed_nano:nano33ble", BuildBoard: "ARDUINO_NANO33BLE", LibsInfo: []*UsedLibrary{spi, wire}},
+		// the result.json written by older versions doesn't contain build.board
+		{Fqbn: "arduino:avr:uno", LibsInfo: []*UsedLibrary{spi, servo}},
+		{Fqbn: "arduino:avr:mega", LibsInfo: []*UsedLibrary{spi}},
+	}
+	headerPath := tmpDir.Join("libsketch.h")
+	if err := createLibSketchHeaderFile(headerPath, targets, []string{"api.h"}); err != nil {
+		t.Fatal(err)
+	}
+	// the libraries used by every target are not guarded, the ones used by all the targets of an architecture
+	// are guarded by its macro, the other ones by the macro of every board using them
+	expected := `#include "SPI.h"
+#if defined(ARDUINO_SAMD_MKR1000)
+#include "WiFi101.h"
+#endif
+#if defined(ARDUINO_SAMD_MKRWIFI1010)
+#include "WiFiNINA.h"
+#endif
+#if defined(ARDUINO_SAMD_MKRWIFI1010) || defined(ARDUINO_ARCH_MBED_NANO)
+#include "Wire.h"
+#endif
+#if defined(ARDUINO_ARCH_AVR)
+#include "Servo.h"
+#endif
+#include "api.h"
+void _setup();
+void _loop();`
+	content, err := headerPath.ReadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", content, expected)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// libraryIndex contains the libraries available in the Library Manager, the nil libraryIndex contains every library
+type libraryIndex struct {
+	// releases contains the name@version of every release
+	releases map[string]bool
+}
+
+// readLibraryIndex reads the library_index.json downloaded by the arduino-cli in its data directory, the index is not updated.
+// If the index cannot be read a warning is logged and nil is returned: every library is assumed to be in the Library Manager
+func readLibraryIndex(config *cliConfig) *libraryIndex {
+	index, err := loadLibraryIndex(config)
+	if err != nil {
+		logrus.Warnf("cannot read the library index, all the libraries installed in the sketchbook are assumed to be in the Library Manager: %s", err)
+		return nil
+	}
+	return index
+}
+
+// loadLibraryIndex reads the library_index.json in the data directory of the arduino-cli
+func loadLibraryIndex(config *cliConfig) (*libraryIndex, error) {
+	if config.Directories.Data == "" {
+		return nil, errors.New("the arduino-cli data directory is not set")
+	}
+	indexPath := paths.New(config.Directories.Data, "library_index.json")
+	file, err := os.Open(indexPath.String())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var content struct {
+		Libraries []struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"libraries"`
+	}
+	if err := json.NewDecoder(file).Decode(&content); err != nil {
+		return nil, errors.New("cannot parse " + indexPath.String() + ": " + err.Error())
+	}
+	index := &libraryIndex{releases: map[string]bool{}}
+	for _, release := range content.Libraries {
+		index.releases[release.Name+"@"+release.Version] = true
+	}
+	return index, nil
+}
+
+// contains returns true if the version of the library named name can be installed from the Library Manager
+func (i *libraryIndex) contains(name, version string) bool {
+	return i == nil || i.releases[name+"@"+version]
+}
@@ -0,0 +1,173 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	semver "go.bug.st/relaxed-semver"
+)
+
+// LibraryProperties contains the metadata written in the library.properties of the precompiled library,
+// see https://arduino.github.io/arduino-cli/latest/library-specification/#libraryproperties-file-format
+// The empty fields get a default value.
+type LibraryProperties struct {
+	// Name defaults to the name of the sketch
+	Name string
+	// Version must be semver compliant, it defaults to 1.0.0
+	Version string
+	// Author is a comma separated list of the authors, e.g. "Jane Doe <jane@example.com>, John Doe", it's required
+	Author string
+	// Maintainer defaults to Author
+	Maintainer string
+	Sentence   string
+	Paragraph  string
+	// Category must be one of the categories listed by the specification, it can be left empty
+	Category string
+	// Url must be an http or https URL
+	Url string
+	// License is the SPDX identifier of the license of the sketch, e.g. "MIT". It's not part of the specification,
+	// it's written in library.properties only if set and it's ignored by the arduino-cli
+	License string
+}
+
+// libraryPropertiesKeys are the keys of the LibraryProperties fields, in the order they are written in library.properties
+var libraryPropertiesKeys = []string{"name", "version", "author", "maintainer", "sentence", "paragraph", "category", "url", "license"}
+
+// libraryCategories are the values allowed for the category field
+var libraryCategories = []string{
+	"Display",
+	"Communication",
+	"Signal Input/Output",
+	"Sensors",
+	"Device Control",
+	"Timing",
+	"Data Storage",
+	"Data Processing",
+	"Other",
+	"Uncategorized",
+}
+
+var (
+	libraryNameRegexp    = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9 _.\-]*$`)
+	libraryLicenseRegexp = regexp.MustCompile(`^[a-zA-Z0-9 .+\-()]+$`)
+)
+
+// LoadLibraryProperties reads the LibraryProperties from the file in configPath,
+// it uses the library.properties format: every line is key=value, the keys are the ones of library.properties (e.g. author=Jane Doe)
+// plus license. The values are not validated, this is done by Precompile after applying the defaults.
+func LoadLibraryProperties(configPath string) (*LibraryProperties, error) {
+	return loadLibraryProperties(configPath, false)
+}
+
+// loadLibraryProperties reads the library metadata from the file in configPath, if ignoreUnknown is true the unknown keys
+// are skipped instead of returning an error, e.g. to read the library.properties of a precompiled library (precompiled=true)
+func loadLibraryProperties(configPath string, ignoreUnknown bool) (*LibraryProperties, error) {
+	content, err := paths.New(configPath).ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	props, err := parseProperties(content)
+	if err != nil {
+		// the error is about the whole file, LibraryPropertyError is only about a single property
+		return nil, fmt.Errorf("cannot read the library properties in %s: %w", configPath, err)
+	}
+	res := &LibraryProperties{}
+	fields := res.fields()
+	for _, key := range props.keys {
+		field, ok := fields[key]
+		if !ok && ignoreUnknown {
+			continue
+		} else if !ok {
+			return nil, &LibraryPropertyError{Property: key, Reason: "unknown property in " + configPath}
+		}
+		*field, _ = props.get(key)
+	}
+	return res, nil
+}
+
+// fields returns a pointer to every field, indexed by the key used in library.properties
+func (p *LibraryProperties) fields() map[string]*string {
+	return map[string]*string{
+		"name":       &p.Name,
+		"version":    &p.Version,
+		"author":     &p.Author,
+		"maintainer": &p.Maintainer,
+		"sentence":   &p.Sentence,
+		"paragraph":  &p.Paragraph,
+		"category":   &p.Category,
+		"url":        &p.Url,
+		"license":    &p.License,
+	}
+}
+
+// withDefaults returns a copy of p where the empty fields have their default value
+func (p LibraryProperties) withDefaults(sketchName string) *LibraryProperties {
+	if p.Name == "" {
+		p.Name = sketchName
+	}
+	if p.Version == "" {
+		p.Version = "1.0.0"
+	}
+	if p.Maintainer == "" {
+		p.Maintainer = p.Author
+	}
+	if p.Sentence == "" {
+		p.Sentence = "This technically is not a library but a precompiled sketch. The result is produced using arduino-cslt"
+	}
+	if p.Url == "" {
+		p.Url = "https://github.com/arduino/arduino-cslt"
+	}
+	return &p
+}
+
+// validate checks the values following the Arduino library specification
+func (p *LibraryProperties) validate() error {
+	fields := p.fields()
+	for _, key := range libraryPropertiesKeys {
+		if value := *fields[key]; strings.ContainsAny(value, "\r\n") {
+			return &LibraryPropertyError{Property: key, Value: value, Reason: "it must be on a single line"}
+		}
+	}
+	if len(p.Name) > 63 || !libraryNameRegexp.MatchString(p.Name) {
+		return &LibraryPropertyError{Property: "name", Value: p.Name,
+			Reason: "it must start with a letter or a number and contain only letters, numbers, spaces, underscores, dots and dashes, up to 63 characters"}
+	}
+	// the older versions of the tool wrote TODO, it could still be found in a --lib-config copied from their output
+	for _, key := range []string{"author", "maintainer"} {
+		if value := strings.TrimSpace(*fields[key]); value == "" {
+			return &LibraryPropertyError{Property: key, Reason: "it's required, e.g. Jane Doe <jane@example.com>"}
+		} else if strings.EqualFold(value, "TODO") {
+			return &LibraryPropertyError{Property: key, Value: value, Reason: "it's a placeholder, it must contain a name, e.g. Jane Doe <jane@example.com>"}
+		}
+	}
+	if _, err := semver.Parse(p.Version); err != nil {
+		return &LibraryPropertyError{Property: "version", Value: p.Version, Reason: "it must be semver compliant, e.g. 1.2.0"}
+	}
+	if p.Category != "" && !contains(libraryCategories, p.Category) {
+		return &LibraryPropertyError{Property: "category", Value: p.Category, Reason: "it must be one of: " + strings.Join(libraryCategories, ", ")}
+	}
+	if u, err := url.Parse(p.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &LibraryPropertyError{Property: "url", Value: p.Url, Reason: "it must be an http or https URL"}
+	}
+	if p.License != "" && !libraryLicenseRegexp.MatchString(p.License) {
+		return &LibraryPropertyError{Property: "license", Value: p.License, Reason: "it must be an SPDX license identifier or expression, e.g. MIT"}
+	}
+	return nil
+}
+
+// contains is an helper function that returns true if value is in values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
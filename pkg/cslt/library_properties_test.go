@@ -0,0 +1,123 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+func TestLibraryPropertiesWithDefaults(t *testing.T) {
+	author := "Jane Doe <jane@example.com>"
+	for _, test := range []struct {
+		name     string
+		props    LibraryProperties
+		expected LibraryProperties
+	}{
+		{
+			name:  "defaults",
+			props: LibraryProperties{Author: author},
+			expected: LibraryProperties{Name: "sketch", Version: "1.0.0", Author: author, Maintainer: author,
+				Sentence: "This technically is not a library but a precompiled sketch. The result is produced using arduino-cslt",
+				Url:      "https://github.com/arduino/arduino-cslt"},
+		},
+		{
+			name: "values kept",
+			props: LibraryProperties{Name: "Blink", Version: "2.1.0", Author: author, Maintainer: "Acme Inc.",
+				Sentence: "Blinks", Paragraph: "A LED", Category: "Other", Url: "https://example.com", License: "MIT"},
+			expected: LibraryProperties{Name: "Blink", Version: "2.1.0", Author: author, Maintainer: "Acme Inc.",
+				Sentence: "Blinks", Paragraph: "A LED", Category: "Other", Url: "https://example.com", License: "MIT"},
+		},
+	} {
+		props := test.props
+		res := props.withDefaults("sketch")
+		if *res != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.name, *res, test.expected)
+		}
+		if props != test.props {
+			t.Errorf("%s: the properties have been modified", test.name)
+		}
+	}
+}
+
+func TestLibraryPropertiesValidate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		props    LibraryProperties
+		property string // the property expected to be invalid, empty if the properties are valid
+	}{
+		{"valid", LibraryProperties{Author: "Jane Doe"}, ""},
+		{"all the fields", LibraryProperties{Name: "My_Lib-2.0", Version: "2.1.0-rc.1", Author: "Jane Doe, John Doe", Maintainer: "Acme Inc.",
+			Category: "Device Control", Url: "http://example.com/lib", License: "MIT OR Apache-2.0"}, ""},
+		{"missing author", LibraryProperties{}, "author"},
+		{"blank author", LibraryProperties{Author: "  "}, "author"},
+		{"TODO author", LibraryProperties{Author: "TODO"}, "author"},
+		{"TODO maintainer", LibraryProperties{Author: "Jane Doe", Maintainer: "todo"}, "maintainer"},
+		{"multi-line sentence", LibraryProperties{Author: "Jane Doe", Sentence: "first\nsecond"}, "sentence"},
+		{"invalid name", LibraryProperties{Name: "-lib", Author: "Jane Doe"}, "name"},
+		{"long name", LibraryProperties{Name: strings.Repeat("a", 64), Author: "Jane Doe"}, "name"},
+		{"not semver", LibraryProperties{Author: "Jane Doe", Version: "one"}, "version"},
+		{"relaxed semver", LibraryProperties{Author: "Jane Doe", Version: "1.2"}, ""},
+		{"invalid category", LibraryProperties{Author: "Jane Doe", Category: "Robots"}, "category"},
+		{"category case", LibraryProperties{Author: "Jane Doe", Category: "device control"}, "category"},
+		{"not http", LibraryProperties{Author: "Jane Doe", Url: "ftp://example.com"}, "url"},
+		{"invalid license", LibraryProperties{Author: "Jane Doe", License: "MIT; rm -rf"}, "license"},
+	} {
+		err := test.props.withDefaults("sketch").validate()
+		var propertyErr *LibraryPropertyError
+		if test.property == "" {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+		} else if !errors.As(err, &propertyErr) || propertyErr.Property != test.property {
+			t.Errorf("%s: got %v, expected an invalid %s", test.name, err, test.property)
+		}
+	}
+}
+
+func TestLoadLibraryProperties(t *testing.T) {
+	tmpDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpDir.RemoveAll()
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected LibraryProperties
+		err      string
+	}{
+		{
+			name:     "library.properties format",
+			content:  "# metadata\nauthor=Jane Doe <jane@example.com>\nversion = 2.1.0\ncategory=Device Control\nlicense=MIT\n",
+			expected: LibraryProperties{Author: "Jane Doe <jane@example.com>", Version: "2.1.0", Category: "Device Control", License: "MIT"},
+		},
+		{
+			name:    "unknown property",
+			content: "author=Jane Doe\nprecompiled=true\n",
+			err:     "invalid library property precompiled",
+		},
+	} {
+		configPath := tmpDir.Join("lib.properties")
+		if err := configPath.WriteFile([]byte(test.content)); err != nil {
+			t.Fatal(err)
+		}
+		props, err := LoadLibraryProperties(configPath.String())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if *props != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.name, *props, test.expected)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// LicenseAction is what to do with a core or a library, depending on its license
+type LicenseAction string
+
+const (
+	// LicenseAllow accepts the license
+	LicenseAllow LicenseAction = "allow"
+	// LicenseWarn accepts the license, but a warning is logged
+	LicenseWarn LicenseAction = "warn"
+	// LicenseDeny makes Precompile fail before creating the library
+	LicenseDeny LicenseAction = "deny"
+)
+
+// licenseActions contains the actions sorted from the most to the least permissive
+var licenseActions = []LicenseAction{LicenseAllow, LicenseWarn, LicenseDeny}
+
+// LicensePolicy tells which licenses the cores and the libraries linked with the precompiled library can have.
+// The licenses are matched against patterns using the path.Match syntax (e.g. "GPL-*"), ignoring the case.
+// If a license matches more than one list, deny wins over warn and warn wins over allow
+type LicensePolicy struct {
+	Allow []string
+	Warn  []string
+	Deny  []string
+	// Default is the action for the licenses not matching any pattern and for the unknown ones, it defaults to LicenseWarn
+	Default LicenseAction
+}
+
+// LoadLicensePolicy reads the license policy from the file in policyPath, it uses the same format of library.properties:
+// the allow, warn and deny keys contain comma separated lists of patterns and default contains an action, e.g.
+//
+//	allow=MIT, BSD-*, Apache-2.0, LGPL-*
+//	deny=GPL-*, AGPL-*
+//	default=warn
+func LoadLicensePolicy(policyPath string) (*LicensePolicy, error) {
+	content, err := paths.New(policyPath).ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	props, err := parseProperties(content)
+	if err != nil {
+		return nil, &LicensePolicyError{Path: policyPath, Reason: err.Error()}
+	}
+	policy := &LicensePolicy{}
+	for _, key := range props.keys {
+		value, _ := props.get(key)
+		var patterns []string
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+		switch key {
+		case string(LicenseAllow):
+			policy.Allow = patterns
+		case string(LicenseWarn):
+			policy.Warn = patterns
+		case string(LicenseDeny):
+			policy.Deny = patterns
+		case "default":
+			policy.Default = LicenseAction(value)
+		default:
+			return nil, &LicensePolicyError{Path: policyPath, Reason: fmt.Sprintf("unknown key %q, it must be allow, warn, deny or default", key)}
+		}
+	}
+	if err := policy.validate(); err != nil {
+		return nil, &LicensePolicyError{Path: policyPath, Reason: err.Error()}
+	}
+	return policy, nil
+}
+
+// validate checks that the patterns and the default action of the policy are valid
+func (p *LicensePolicy) validate() error {
+	switch p.Default {
+	case "", LicenseAllow, LicenseWarn, LicenseDeny:
+	default:
+		return fmt.Errorf("invalid default %q, it must be allow, warn or deny", p.Default)
+	}
+	for _, pattern := range append(append(append([]string{}, p.Allow...), p.Warn...), p.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// licenseAction returns the action for a single license and the reason why it was chosen, e.g. the pattern matching the license
+func (p *LicensePolicy) licenseAction(license string) (LicenseAction, string) {
+	if action, reason, ok := p.matchLicense(license); ok {
+		return action, reason
+	}
+	action := p.Default
+	if action == "" {
+		action = LicenseWarn
+	}
+	return action, fmt.Sprintf("%s is not listed, default=%s", license, action)
+}
+
+// matchLicense returns the action of the first pattern matching license, deny patterns first.
+// A license with an exception (e.g. "GPL-3.0-only WITH GCC-exception-3.1") is only matched by the patterns containing an exception,
+// and the other way around, this way "GPL-*" doesn't match the licenses with an exception
+func (p *LicensePolicy) matchLicense(license string) (LicenseAction, string, bool) {
+	withException := strings.Contains(strings.ToLower(license), " with ")
+	for _, list := range []struct {
+		action   LicenseAction
+		patterns []string
+	}{{LicenseDeny, p.Deny}, {LicenseWarn, p.Warn}, {LicenseAllow, p.Allow}} {
+		for _, pattern := range list.patterns {
+			if strings.Contains(strings.ToLower(pattern), " with ") != withException {
+				continue
+			}
+			if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(license)); matched {
+				return list.action, fmt.Sprintf("%s matches %s=%s", license, list.action, pattern), true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// action returns the action for license and the reason why it was chosen. The license can be an SPDX expression:
+// parentheses bind first, then AND, then OR. With AND the least permissive term is chosen, with OR the most permissive alternative.
+// A license with an exception (WITH) gets the action of the patterns matching it with the exception, if any, otherwise the one of the license.
+// An empty license is unknown, an expression that cannot be parsed gets the least permissive action
+func (p *LicensePolicy) action(license string) (LicenseAction, string) {
+	if strings.TrimSpace(license) == "" {
+		action, _ := p.licenseAction("")
+		return action, fmt.Sprintf("the license is unknown, default=%s", action)
+	}
+	parser := &licenseExpressionParser{
+		policy: p,
+		tokens: strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(license)),
+	}
+	action, reason, err := parser.parseOr()
+	if err == nil && parser.pos < len(parser.tokens) {
+		err = fmt.Errorf("unexpected %s", parser.tokens[parser.pos])
+	}
+	if err != nil {
+		action = licenseActions[len(licenseActions)-1]
+		return action, fmt.Sprintf("cannot parse the license %q: %s, using %s", license, err, action)
+	}
+	return action, reason
+}
+
+// licenseExpressionParser evaluates an SPDX license expression against a policy, while parsing it
+type licenseExpressionParser struct {
+	policy *LicensePolicy
+	tokens []string
+	pos    int
+}
+
+// next returns the next token and moves past it, an empty string is returned at the end of the expression
+func (l *licenseExpressionParser) next() string {
+	if l.pos >= len(l.tokens) {
+		return ""
+	}
+	l.pos++
+	return l.tokens[l.pos-1]
+}
+
+// nextIs moves past the next token and returns true if it's the operator op, in upper or lower case
+func (l *licenseExpressionParser) nextIs(op string) bool {
+	if l.pos < len(l.tokens) && isLicenseOperator(l.tokens[l.pos], op) {
+		l.pos++
+		return true
+	}
+	return false
+}
+
+// isLicenseOperator returns true if tok is the operator op, SPDX allows it in upper or lower case
+func isLicenseOperator(tok, op string) bool {
+	return tok == op || tok == strings.ToLower(op)
+}
+
+// parseOr parses the alternatives separated by OR and returns the most permissive action
+func (l *licenseExpressionParser) parseOr() (LicenseAction, string, error) {
+	action, reason, err := l.parseAnd()
+	for err == nil && l.nextIs("OR") {
+		var alternative LicenseAction
+		var alternativeReason string
+		if alternative, alternativeReason, err = l.parseAnd(); err == nil && actionIndex(alternative) < actionIndex(action) {
+			action, reason = alternative, alternativeReason
+		}
+	}
+	return action, reason, err
+}
+
+// parseAnd parses the terms separated by AND and returns the least permissive action
+func (l *licenseExpressionParser) parseAnd() (LicenseAction, string, error) {
+	action, reason, err := l.parseTerm()
+	for err == nil && l.nextIs("AND") {
+		var term LicenseAction
+		var termReason string
+		if term, termReason, err = l.parseTerm(); err == nil && actionIndex(term) > actionIndex(action) {
+			action, reason = term, termReason
+		}
+	}
+	return action, reason, err
+}
+
+// parseTerm parses a parenthesized expression or a license, optionally followed by WITH and an exception
+func (l *licenseExpressionParser) parseTerm() (LicenseAction, string, error) {
+	tok := l.next()
+	switch {
+	case tok == "":
+		return "", "", fmt.Errorf("unexpected end")
+	case tok == "(":
+		action, reason, err := l.parseOr()
+		if err != nil {
+			return "", "", err
+		}
+		if l.next() != ")" {
+			return "", "", fmt.Errorf("missing )")
+		}
+		return action, reason, nil
+	case !isLicenseIdentifier(tok):
+		return "", "", fmt.Errorf("unexpected %s", tok)
+	}
+	if !l.nextIs("WITH") {
+		action, reason := l.policy.licenseAction(tok)
+		return action, reason, nil
+	}
+	exception := l.next()
+	if !isLicenseIdentifier(exception) {
+		return "", "", fmt.Errorf("missing the exception of %s", tok)
+	}
+	if action, reason, ok := l.policy.matchLicense(tok + " WITH " + exception); ok {
+		return action, reason, nil
+	}
+	action, reason := l.policy.licenseAction(tok)
+	return action, reason + ", the exception " + exception + " is not listed", nil
+}
+
+// isLicenseIdentifier returns true if tok can be a license or an exception identifier
+func isLicenseIdentifier(tok string) bool {
+	if tok == "" || tok == "(" || tok == ")" {
+		return false
+	}
+	for _, op := range []string{"AND", "OR", "WITH"} {
+		if isLicenseOperator(tok, op) {
+			return false
+		}
+	}
+	return true
+}
+
+// actionIndex returns the position of action in licenseActions, the higher the less permissive
+func actionIndex(action LicenseAction) int {
+	for i, a := range licenseActions {
+		if a == action {
+			return i
+		}
+	}
+	return len(licenseActions)
+}
+
+// checkLicensePolicy checks the licenses of the cores and of the libraries used by targets against policy:
+// a warning is logged for every license to warn about, a LicenseDeniedError reporting all the denied ones is returned
+func checkLicensePolicy(policy *LicensePolicy, targets []*Target) error {
+	if policy == nil {
+		return nil
+	}
+	var denied []string
+	for _, component := range thirdPartyComponents(targets) {
+		kind := "library"
+		if component.platform {
+			kind = "core"
+		}
+		description := fmt.Sprintf("%s@%s (%s)", component.name, component.version, kind)
+		switch action, reason := policy.action(component.license); action {
+		case LicenseWarn:
+			logrus.Warnf("license of %s: %s", description, reason)
+		case LicenseDeny:
+			denied = append(denied, description+": "+reason)
+		}
+	}
+	if len(denied) > 0 {
+		return &LicenseDeniedError{Denied: denied}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import "testing"
+
+func TestLicensePolicyAction(t *testing.T) {
+	policy := &LicensePolicy{
+		Allow: []string{"MIT", "BSD-*", "Apache-2.0", "LGPL-*", "GPL-* WITH GCC-exception-*"},
+		Warn:  []string{"MPL-*"},
+		Deny:  []string{"GPL-*", "AGPL-*", "LGPL-2.0*"},
+	}
+	for _, test := range []struct {
+		license  string
+		expected LicenseAction
+		reason   string
+	}{
+		{"MIT", LicenseAllow, "MIT matches allow=MIT"},
+		{"mit", LicenseAllow, "mit matches allow=MIT"},
+		{"BSD-3-Clause", LicenseAllow, "BSD-3-Clause matches allow=BSD-*"},
+		{"MPL-2.0", LicenseWarn, "MPL-2.0 matches warn=MPL-*"},
+		{"GPL-3.0-or-later", LicenseDeny, "GPL-3.0-or-later matches deny=GPL-*"},
+		// deny wins over allow
+		{"LGPL-2.0-only", LicenseDeny, "LGPL-2.0-only matches deny=LGPL-2.0*"},
+		{"LGPL-2.1-or-later", LicenseAllow, "LGPL-2.1-or-later matches allow=LGPL-*"},
+		{"Zlib", LicenseWarn, "Zlib is not listed, default=warn"},
+		{"", LicenseWarn, "the license is unknown, default=warn"},
+		// the most permissive alternative
+		{"GPL-2.0-only OR MIT", LicenseAllow, "MIT matches allow=MIT"},
+		{"(MPL-2.0 OR GPL-2.0-only)", LicenseWarn, "MPL-2.0 matches warn=MPL-*"},
+		// the least permissive term
+		{"MIT AND MPL-2.0", LicenseWarn, "MPL-2.0 matches warn=MPL-*"},
+		{"MIT AND GPL-3.0-only", LicenseDeny, "GPL-3.0-only matches deny=GPL-*"},
+		{"(MIT AND GPL-3.0-only) OR (BSD-2-Clause AND Apache-2.0)", LicenseAllow, "BSD-2-Clause matches allow=BSD-*"},
+		// parentheses bind first, then AND, then OR
+		{"(MIT OR Apache-2.0) AND GPL-3.0-only", LicenseDeny, "GPL-3.0-only matches deny=GPL-*"},
+		{"MIT OR Apache-2.0 AND GPL-3.0-only", LicenseAllow, "MIT matches allow=MIT"},
+		{"GPL-3.0-only AND (MPL-2.0 OR (MIT AND Zlib))", LicenseDeny, "GPL-3.0-only matches deny=GPL-*"},
+		{"mit and mpl-2.0", LicenseWarn, "mpl-2.0 matches warn=MPL-*"},
+		// exceptions
+		{"GPL-3.0-or-later WITH GCC-exception-3.1", LicenseAllow, "GPL-3.0-or-later WITH GCC-exception-3.1 matches allow=GPL-* WITH GCC-exception-*"},
+		{"GPL-2.0-only WITH Classpath-exception-2.0", LicenseDeny, "GPL-2.0-only matches deny=GPL-*, the exception Classpath-exception-2.0 is not listed"},
+		{"MIT AND (GPL-3.0-only WITH GCC-exception-3.1)", LicenseAllow, "MIT matches allow=MIT"},
+		// invalid expressions
+		{"MIT AND", LicenseDeny, `cannot parse the license "MIT AND": unexpected end, using deny`},
+		{"(MIT OR Apache-2.0", LicenseDeny, `cannot parse the license "(MIT OR Apache-2.0": missing ), using deny`},
+		{"MIT Apache-2.0", LicenseDeny, `cannot parse the license "MIT Apache-2.0": unexpected Apache-2.0, using deny`},
+		{"GPL-3.0-only WITH", LicenseDeny, `cannot parse the license "GPL-3.0-only WITH": missing the exception of GPL-3.0-only, using deny`},
+	} {
+		action, reason := policy.action(test.license)
+		if action != test.expected || reason != test.reason {
+			t.Errorf("%q: got %s (%s), expected %s (%s)", test.license, action, reason, test.expected, test.reason)
+		}
+	}
+
+	policy.Default = LicenseDeny
+	for _, license := range []string{"Zlib", ""} {
+		if action, _ := policy.action(license); action != LicenseDeny {
+			t.Errorf("%q: got %s, expected the default %s", license, action, LicenseDeny)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// thirdPartyLicensesFileName is the name of the file, in the output directory, containing the licenses of the cores and libraries
+const thirdPartyLicensesFileName = "THIRD_PARTY_LICENSES"
+
+// licenseFilePrefixes are the prefixes of the names of the files containing the license of a core or a library,
+// e.g. LICENSE, LICENSE.txt or COPYING.LESSER
+var licenseFilePrefixes = []string{"LICENSE", "LICENCE", "COPYING"}
+
+// knownLicenses are the licenses recognized in the license files, in the order they are checked:
+// the titles are matched at the beginning of the text, the phrases anywhere and all of them must be present.
+// The license files don't say if later versions of the GNU licenses can be used, so the generic SPDX identifiers are used
+var knownLicenses = []struct {
+	id      string
+	title   *regexp.Regexp
+	phrases []string
+}{
+	{id: "AGPL-3.0", title: regexp.MustCompile(`GNU AFFERO GENERAL PUBLIC LICENSE Version 3`)},
+	{id: "LGPL-3.0", title: regexp.MustCompile(`GNU LESSER GENERAL PUBLIC LICENSE Version 3`)},
+	{id: "LGPL-2.1", title: regexp.MustCompile(`GNU LESSER GENERAL PUBLIC LICENSE Version 2\.1`)},
+	{id: "LGPL-2.0", title: regexp.MustCompile(`GNU LIBRARY GENERAL PUBLIC LICENSE Version 2`)},
+	{id: "GPL-3.0", title: regexp.MustCompile(`GNU GENERAL PUBLIC LICENSE Version 3`)},
+	{id: "GPL-2.0", title: regexp.MustCompile(`GNU GENERAL PUBLIC LICENSE Version 2`)},
+	{id: "Apache-2.0", title: regexp.MustCompile(`Apache License,? Version 2\.0`)},
+	{id: "MPL-2.0", title: regexp.MustCompile(`Mozilla Public License,? (Version|v\.) 2\.0`)},
+	{id: "MIT", phrases: []string{"Permission is hereby granted, free of charge, to any person obtaining a copy"}},
+	{id: "ISC", phrases: []string{"Permission to use, copy, modify, and/or distribute this software for any purpose"}},
+	{id: "BSD-3-Clause", phrases: []string{"Redistribution and use in source and binary forms", "Neither the name of"}},
+	{id: "BSD-2-Clause", phrases: []string{"Redistribution and use in source and binary forms"}},
+	{id: "Unlicense", phrases: []string{"This is free and unencumbered software released into the public domain"}},
+}
+
+// whitespacesRegexp matches a sequence of whitespaces, the license texts are compared with the whitespaces collapsed
+var whitespacesRegexp = regexp.MustCompile(`\s+`)
+
+// thirdPartyComponent is a core or a library linked in the firmware together with the precompiled library
+type thirdPartyComponent struct {
+	// platform is true if the component is a core
+	platform   bool
+	name       string
+	version    string
+	license    string
+	installDir string
+}
+
+// thirdPartyComponents returns the cores and the libraries used to compile the sketch for the targets,
+// every component is listed once, the cores first, in the order of the targets
+func thirdPartyComponents(targets []*Target) []*thirdPartyComponent {
+	var components []*thirdPartyComponent
+	found := map[string]bool{}
+	add := func(component *thirdPartyComponent) {
+		if key := component.name + "@" + component.version; !found[key] {
+			found[key] = true
+			components = append(components, component)
+		}
+	}
+	for _, target := range targets {
+		for _, core := range target.platforms() {
+			add(&thirdPartyComponent{platform: true, name: core.Id, version: core.Version, license: core.License, installDir: core.InstallDir})
+		}
+	}
+	for _, target := range targets {
+		for _, lib := range target.LibsInfo {
+			add(&thirdPartyComponent{name: lib.Name, version: lib.Version, license: lib.License, installDir: lib.InstallDir})
+		}
+	}
+	return components
+}
+
+// findLicenseFiles returns the license files in the install directory of a core or a library, they are sorted by name
+func findLicenseFiles(installDir string) paths.PathList {
+	// the libraries specified with --library could have been removed, e.g. when merging
+	if installDir == "" || paths.New(installDir).NotExist() {
+		return nil
+	}
+	files, err := paths.New(installDir).ReadDir()
+	if err != nil {
+		logrus.Warnf("cannot read the license files in %s: %s", installDir, err)
+		return nil
+	}
+	files.FilterOutDirs()
+	var licenseFiles paths.PathList
+	for _, file := range files {
+		for _, prefix := range licenseFilePrefixes {
+			if strings.HasPrefix(strings.ToUpper(file.Base()), prefix) {
+				licenseFiles.Add(file)
+				break
+			}
+		}
+	}
+	licenseFiles.Sort()
+	return licenseFiles
+}
+
+// identifyLicense returns the SPDX identifier of the license in text, or an empty string if it's not recognized
+func identifyLicense(text string) string {
+	text = whitespacesRegexp.ReplaceAllString(text, " ")
+	// the title is at the beginning, the GPL texts mention the other GNU licenses later
+	head := text
+	if len(head) > 500 {
+		head = head[:500]
+	}
+	for _, license := range knownLicenses {
+		if license.title != nil {
+			if license.title.MatchString(head) {
+				return license.id
+			}
+			continue
+		}
+		found := true
+		for _, phrase := range license.phrases {
+			found = found && strings.Contains(text, phrase)
+		}
+		if found {
+			return license.id
+		}
+	}
+	return ""
+}
+
+// detectLicenses sets the license of the platforms and of the libraries used by target, if they don't declare it,
+// looking for the license files in their install directories. The first license recognized is used
+func detectLicenses(target *Target) {
+	detect := func(name, installDir string) string {
+		for _, file := range findLicenseFiles(installDir) {
+			content, err := file.ReadFile()
+			if err != nil {
+				logrus.Warnf("cannot read %s: %s", file.String(), err)
+				continue
+			}
+			if license := identifyLicense(string(content)); license != "" {
+				logrus.Infof("found the %s license of %s in %s", license, name, file.String())
+				return license
+			}
+		}
+		return ""
+	}
+	for _, core := range target.platforms() {
+		if core.License == "" {
+			core.License = detect(core.Id, core.InstallDir)
+		}
+	}
+	for _, lib := range target.LibsInfo {
+		if lib.License == "" {
+			lib.License = detect(lib.Name, lib.InstallDir)
+		}
+	}
+}
+
+// createThirdPartyLicensesFile writes in path the licenses of the cores and of the libraries used to compile the sketch for targets,
+// with the text of their license files if found
+func createThirdPartyLicensesFile(path *paths.Path, targets []*Target) error {
+	separator := strings.Repeat("=", 80)
+	content := []string{"The firmware contains the following third party components, together with the precompiled library."}
+	for _, component := range thirdPartyComponents(targets) {
+		kind := "library"
+		if component.platform {
+			kind = "core"
+		}
+		license := component.license
+		if license == "" {
+			license = "unknown"
+		}
+		content = append(content, "", separator, fmt.Sprintf("%s@%s (%s)", component.name, component.version, kind), "License: "+license, separator)
+		licenseFiles := findLicenseFiles(component.installDir)
+		if len(licenseFiles) == 0 {
+			content = append(content, "", "The license text has not been found.")
+		}
+		for _, file := range licenseFiles {
+			text, err := file.ReadFile()
+			if err != nil {
+				return err
+			}
+			content = append(content, "", "--- "+file.Base()+" ---", "", strings.TrimRight(string(text), "\n"))
+		}
+	}
+	return createFile(path, strings.Join(content, "\n")+"\n")
+}
+
+// licensingParagraph returns the paragraph of the README.md describing the licenses of the cores and of the libraries used for targets
+func licensingParagraph(targets []*Target) string {
+	lines := []string{"The firmware contains additional code from the following components, their licenses are in " + thirdPartyLicensesFileName + ":"}
+	lgpl := false
+	for _, component := range thirdPartyComponents(targets) {
+		license := component.license
+		if license == "" {
+			license = "unknown license"
+		}
+		lgpl = lgpl || strings.Contains(license, "LGPL")
+		kind := ""
+		if component.platform {
+			kind = " (core)"
+		}
+		lines = append(lines, fmt.Sprintf("- `%s@%s`%s: %s", component.name, component.version, kind, license))
+	}
+	if lgpl {
+		lines = append(lines, "", "Some of them are licensed with LGPL clause; in order to re-compile the entire firmware bundle, please execute the following.")
+	} else {
+		lines = append(lines, "", "In order to re-compile the entire firmware bundle, please execute the following.")
+	}
+	return strings.Join(lines, "\n")
+}
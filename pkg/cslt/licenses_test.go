@@ -0,0 +1,42 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIdentifyLicense(t *testing.T) {
+	bsd := "Copyright (c) 2020, Acme\n\nRedistribution and use in source and binary forms, with or without\nmodification, are permitted provided that the following conditions are met:\n"
+	for _, test := range []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"gpl-3", "                    GNU GENERAL PUBLIC LICENSE\n                       Version 3, 29 June 2007\n", "GPL-3.0"},
+		{"gpl-2", "GNU GENERAL PUBLIC LICENSE\nVersion 2, June 1991\n\nThe GNU Library General Public License applies to some other software", "GPL-2.0"},
+		// the LGPL-3.0 text mentions the GPL too
+		{"lgpl-3", "GNU LESSER GENERAL PUBLIC LICENSE\nVersion 3, 29 June 2007\n\nThis version of the GNU Lesser General Public License incorporates\nthe terms and conditions of version 3 of the GNU General Public License", "LGPL-3.0"},
+		{"lgpl-2.1", "\t\t  GNU LESSER GENERAL PUBLIC LICENSE\r\n\t\t       Version 2.1, February 1999\r\n", "LGPL-2.1"},
+		{"lgpl-2.0", "GNU LIBRARY GENERAL PUBLIC LICENSE\nVersion 2, June 1991\n", "LGPL-2.0"},
+		{"agpl-3", "GNU AFFERO GENERAL PUBLIC LICENSE\nVersion 3, 19 November 2007\n", "AGPL-3.0"},
+		{"apache", "\n                                 Apache License\n                           Version 2.0, January 2004\n", "Apache-2.0"},
+		{"mpl", "Mozilla Public License Version 2.0\n==================================\n", "MPL-2.0"},
+		{"mit", "MIT License\n\nCopyright (c) 2021 Acme\n\nPermission is hereby granted, free of charge, to any person obtaining a\ncopy of this software", "MIT"},
+		{"isc", "Permission to use, copy, modify, and/or distribute this software for any\npurpose with or without fee is hereby granted", "ISC"},
+		{"bsd-3", bsd + "3. Neither the name of the copyright holder nor the names of its contributors", "BSD-3-Clause"},
+		{"bsd-2", bsd, "BSD-2-Clause"},
+		{"unlicense", "This is free and unencumbered software released into the public domain.\n", "Unlicense"},
+		// the titles are only matched at the beginning
+		{"gpl mentioned later", strings.Repeat("This library is proprietary. ", 20) + "It's not under the GNU GENERAL PUBLIC LICENSE Version 3", ""},
+		{"unknown", "All rights reserved.\n", ""},
+		{"empty", "", ""},
+	} {
+		if license := identifyLicense(test.text); license != test.expected {
+			t.Errorf("%s: identified %q, expected %q", test.name, license, test.expected)
+		}
+	}
+}
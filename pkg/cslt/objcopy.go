@@ -0,0 +1,230 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultExports are the symbols always kept global by the localization, the sketch linking the library calls them
+var defaultExports = []string{"_setup", "_loop"}
+
+// interruptHandlerRegexp matches the interrupt handlers, they are kept global by the localization: the vector table refers to them
+// and it's not always in the build directory, e.g. the AVR __vector_N are in the avr-libc startup code, the ARM *_Handler in a precompiled library
+var interruptHandlerRegexp = regexp.MustCompile(`^__vector_[0-9]+$|_Handler$`)
+
+// hideObjects processes the object files of target before they are archived, using the toolchain of the platform:
+// if strip is true the debug sections are removed, if localize is true every symbol is made local except _setup, _loop and exports.
+// To localize the symbols the object files are linked in a single relocatable object first, otherwise the references
+// between them would break, the object is named after sketchName. The processed object files replace the original ones in target.
+func hideObjects(ctx context.Context, target *Target, sketchName string, strip, localize bool, exports []string) error {
+	if !strip && !localize {
+		return nil
+	}
+
+	// the main.cpp is not archived, it must not end up in the relocatable object
+	mainCppObjFilePath := target.objFilesDir.Join(mainCppFileName + ".o")
+	var objFilePaths paths.PathList
+	for _, objFilePath := range *target.objFilePaths {
+		if !objFilePath.EqualsTo(mainCppObjFilePath) {
+			objFilePaths.Add(objFilePath)
+		}
+	}
+	// the LTO objects contain the intermediate representation of the code too, objcopy would leave it untouched
+	for _, objFilePath := range objFilePaths {
+		content, err := objFilePath.ReadFile()
+		if err != nil {
+			return err
+		}
+		if isLtoObject(content) {
+			return &LtoObjectsError{Fqbn: target.Fqbn}
+		}
+	}
+
+	objcopyPath, err := target.toolchainCommand("compiler.objcopy.cmd")
+	if err != nil {
+		return err
+	}
+	outputDir := target.objFilesDir.Parent().Join("arduino-cslt-objects")
+	if err := outputDir.MkdirAll(); err != nil {
+		return err
+	}
+
+	var processedFilePaths paths.PathList
+	if localize {
+		ccPath, err := target.toolchainCommand("compiler.c.elf.cmd")
+		if err != nil {
+			return err
+		}
+		sketchObjFilePath := outputDir.Join(sketchName + ".o")
+		cmdArgs := append([]string{"-r", "-nostdlib", "-o", sketchObjFilePath.String()}, objFilePaths.AsStrings()...)
+		if err := runToolchainCommand(ctx, target.Fqbn, ccPath, cmdArgs...); err != nil {
+			return err
+		}
+
+		content, err := sketchObjFilePath.ReadFile()
+		if err != nil {
+			return err
+		}
+		symbols, err := readDefinedSymbols(content)
+		if err != nil {
+			return fmt.Errorf("cannot read the symbols of %s: %s", sketchObjFilePath.String(), err)
+		}
+		cmdArgs = []string{}
+		if strip {
+			cmdArgs = append(cmdArgs, "--strip-debug")
+		}
+		keptSymbols := map[string]bool{}
+		for _, export := range append(append([]string{}, defaultExports...), exports...) {
+			found := false
+			for _, symbol := range symbols {
+				if isExportedSymbol(symbol, export) {
+					keptSymbols[symbol] = true
+					found = true
+				}
+			}
+			if !found {
+				logrus.Warnf("cannot find the symbol %s to export for %s", export, target.Fqbn)
+			}
+		}
+		// the sketch can define symbols used by the core and the libraries (e.g. serialEvent) or override their weak ones
+		// (e.g. yield or the interrupt handlers): if they were local the linker would silently use the default ones of the core
+		requiredSymbols, err := target.symbolsRequiredByOthers(outputDir)
+		if err != nil {
+			return err
+		}
+		var overrides []string
+		for _, symbol := range symbols {
+			if !keptSymbols[symbol] && (requiredSymbols[symbol] || interruptHandlerRegexp.MatchString(symbol)) {
+				keptSymbols[symbol] = true
+				overrides = append(overrides, symbol)
+			}
+		}
+		if len(overrides) > 0 {
+			logrus.Infof("keeping global the symbols used by the core or the libraries for %s: %s", target.Fqbn, strings.Join(overrides, ", "))
+		}
+		for _, symbol := range symbols {
+			if keptSymbols[symbol] {
+				cmdArgs = append(cmdArgs, "--keep-global-symbol="+symbol)
+			}
+		}
+		cmdArgs = append(cmdArgs, sketchObjFilePath.String())
+		if err := runToolchainCommand(ctx, target.Fqbn, objcopyPath, cmdArgs...); err != nil {
+			return err
+		}
+		processedFilePaths.Add(sketchObjFilePath)
+	} else {
+		for _, objFilePath := range objFilePaths {
+			objFileRelPath, err := objFilePath.RelFrom(target.objFilesDir)
+			if err != nil {
+				return err
+			}
+			strippedFilePath := outputDir.JoinPath(objFileRelPath)
+			if err := strippedFilePath.Parent().MkdirAll(); err != nil {
+				return err
+			}
+			if err := runToolchainCommand(ctx, target.Fqbn, objcopyPath, "--strip-debug", objFilePath.String(), strippedFilePath.String()); err != nil {
+				return err
+			}
+			processedFilePaths.Add(strippedFilePath)
+		}
+	}
+
+	target.objFilesDir = outputDir
+	target.objFilePaths = &processedFilePaths
+	return nil
+}
+
+// symbolsRequiredByOthers returns the symbols referenced, or defined as weak, by the objects of the core and of the libraries
+// linked with the sketch: the ones in the build directory, outside the sketch folder and excludedDir, and the precompiled core if used
+func (t *Target) symbolsRequiredByOthers(excludedDir *paths.Path) (map[string]bool, error) {
+	buildFiles, err := t.objFilesDir.Parent().ReadDirRecursive()
+	if err != nil {
+		return nil, err
+	}
+	buildFiles.FilterOutDirs()
+	buildFiles.FilterSuffix(".o", ".a")
+	if t.precompiledCorePath != nil && t.precompiledCorePath.Exist() {
+		buildFiles.Add(t.precompiledCorePath)
+	}
+	required := map[string]bool{}
+	for _, file := range buildFiles {
+		if inside, _ := file.IsInsideDir(t.objFilesDir); inside {
+			continue
+		} else if inside, _ := file.IsInsideDir(excludedDir); inside {
+			continue
+		}
+		content, err := file.ReadFile()
+		if err != nil {
+			return nil, err
+		}
+		objects := [][]byte{content}
+		if file.Ext() == ".a" {
+			if objects, err = readArchiveMembers(content); err != nil {
+				logrus.Warnf("cannot read the archive %s: %s", file.String(), err)
+				continue
+			}
+		}
+		for _, object := range objects {
+			symbols, err := readObjectSymbols(object)
+			if err != nil {
+				// e.g. the archives can contain files that are not objects
+				continue
+			}
+			for _, symbol := range symbols {
+				if symbol.undefined || symbol.weak {
+					required[symbol.name] = true
+				}
+			}
+		}
+	}
+	return required, nil
+}
+
+// toolchainCommand returns the path of the tool of the platform toolchain defined by the cmdProperty build property,
+// e.g. compiler.objcopy.cmd, it's inside the {compiler.path} directory
+func (t *Target) toolchainCommand(cmdProperty string) (string, error) {
+	cmd, ok := t.buildProperties.get(cmdProperty)
+	if !ok || cmd == "" {
+		return "", &BuildPropertyError{Fqbn: t.Fqbn, Property: cmdProperty}
+	}
+	compilerPath, _ := t.buildProperties.get("compiler.path")
+	return t.buildProperties.expand(compilerPath + cmd), nil
+}
+
+// runToolchainCommand runs the tool in toolPath with cmdArgs, the output of the tool is part of the error returned
+func runToolchainCommand(ctx context.Context, fqbn, toolPath string, cmdArgs ...string) error {
+	logrus.Infof("running: %s %s", toolPath, strings.Join(cmdArgs, " "))
+	if cmdOutput, err := exec.CommandContext(ctx, toolPath, cmdArgs...).CombinedOutput(); err != nil {
+		return &CompileError{Fqbn: fqbn, CompilerErr: string(cmdOutput), Err: err}
+	}
+	return nil
+}
+
+// isExportedSymbol returns true if symbol is the one of the export name: the name can be the one of a C symbol,
+// or the name of a C++ function, also inside a namespace (e.g. config::init), in that case every overload matches
+func isExportedSymbol(symbol, name string) bool {
+	if symbol == name {
+		return true
+	}
+	// the C++ mangled names are _Z<length><name><parameters> or _ZN<length><namespace>...<length><name>E<parameters>
+	parts := strings.Split(name, "::")
+	mangledName := ""
+	for _, part := range parts {
+		mangledName += strconv.Itoa(len(part)) + part
+	}
+	if len(parts) > 1 {
+		return strings.HasPrefix(symbol, "_ZN"+mangledName+"E")
+	}
+	return strings.HasPrefix(symbol, "_Z"+mangledName)
+}
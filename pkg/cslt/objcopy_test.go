@@ -0,0 +1,153 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// newTestTarget compiles the sketch sources with the host gcc in buildDir/sketch, and the core sources in buildDir/core/core.a,
+// like the arduino-cli does. The target uses the host toolchain
+func newTestTarget(t *testing.T, buildDir *paths.Path, flags []string, sketchSources, coreSources map[string]string) *Target {
+	compile := func(dir *paths.Path, sources map[string]string) paths.PathList {
+		if err := dir.MkdirAll(); err != nil {
+			t.Fatal(err)
+		}
+		var objFilePaths paths.PathList
+		for name, source := range sources {
+			sourcePath := dir.Join(name)
+			if err := sourcePath.WriteFile([]byte(source)); err != nil {
+				t.Fatal(err)
+			}
+			objFilePath := dir.Join(name + ".o")
+			cmdArgs := append(append([]string{}, flags...), "-O2", "-c", sourcePath.String(), "-o", objFilePath.String())
+			if output, err := exec.Command("gcc", cmdArgs...).CombinedOutput(); err != nil {
+				t.Fatalf("gcc %s: %s\n%s", strings.Join(cmdArgs, " "), err, output)
+			}
+			objFilePaths.Add(objFilePath)
+		}
+		return objFilePaths
+	}
+
+	sketchObjFilePaths := compile(buildDir.Join("sketch"), sketchSources)
+	var coreMembers []*archiveMember
+	for _, objFilePath := range compile(buildDir.Join("core"), coreSources) {
+		member, err := newArchiveMember(objFilePath.Base(), objFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coreMembers = append(coreMembers, member)
+	}
+	if err := writeArchive(buildDir.Join("core", "core.a"), coreMembers, false); err != nil {
+		t.Fatal(err)
+	}
+	buildProperties, err := parseProperties([]byte("compiler.path=\ncompiler.objcopy.cmd=objcopy\ncompiler.c.elf.cmd=gcc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Target{
+		Fqbn:            "test:host:gcc",
+		objFilesDir:     buildDir.Join("sketch"),
+		objFilePaths:    &sketchObjFilePaths,
+		buildProperties: buildProperties,
+	}
+}
+
+func TestHideObjectsKeepsCoreOverrides(t *testing.T) {
+	for _, tool := range []string{"gcc", "objcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " is not installed")
+		}
+	}
+	buildDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buildDir.RemoveAll()
+
+	target := newTestTarget(t, buildDir, nil, map[string]string{
+		"sketch.c": `int yielded, events;
+int helper(void) { return 1; }
+void yield(void) { yielded = helper(); }
+void serialEvent(void) { events++; }
+void USART_Handler(void) {}
+void _setup(void) {}
+void _loop(void) { yield(); }
+int status(void) { return yielded == 1 && events == 1 ? 0 : 1; }
+`,
+	}, map[string]string{
+		"hooks.c": `__attribute__((weak)) void yield(void) {}
+extern void serialEvent(void) __attribute__((weak));
+void runEvents(void) { yield(); if (serialEvent) serialEvent(); }
+`,
+	})
+	if err := hideObjects(context.Background(), target, "sketch", true, true, []string{"status"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*target.objFilePaths) != 1 {
+		t.Fatalf("expected a single relocatable object, got %v", *target.objFilePaths)
+	}
+	content, err := (*target.objFilePaths)[0].ReadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols, err := readDefinedSymbols(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global := map[string]bool{}
+	for _, symbol := range symbols {
+		global[symbol] = true
+	}
+	for symbol, expected := range map[string]bool{
+		"_setup": true, "_loop": true, "status": true, // the exports
+		"yield": true, "serialEvent": true, "USART_Handler": true, // used by the core
+		"helper": false, "yielded": false, "events": false,
+	} {
+		if global[symbol] != expected {
+			t.Errorf("%s global: %v, expected %v", symbol, global[symbol], expected)
+		}
+	}
+
+	// the core must call the functions of the sketch, not its weak defaults
+	mainPath := buildDir.Join("main.c")
+	mainPath.WriteFile([]byte("void _setup(void);\nvoid _loop(void);\nvoid runEvents(void);\nint status(void);\nint main(void) { _setup(); _loop(); runEvents(); return status(); }\n"))
+	firmwarePath := buildDir.Join("firmware")
+	cmdArgs := []string{mainPath.String(), (*target.objFilePaths)[0].String(), buildDir.Join("core", "core.a").String(), "-o", firmwarePath.String()}
+	if output, err := exec.Command("gcc", cmdArgs...).CombinedOutput(); err != nil {
+		t.Fatalf("cannot link the localized object: %s\n%s", err, output)
+	}
+	if output, err := exec.Command(firmwarePath.String()).CombinedOutput(); err != nil {
+		t.Errorf("the core doesn't call the functions of the sketch: %s\n%s", err, output)
+	}
+}
+
+func TestHideObjectsRefusesLto(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not installed")
+	}
+	buildDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buildDir.RemoveAll()
+
+	target := newTestTarget(t, buildDir, []string{"-flto", "-fno-fat-lto-objects"}, map[string]string{
+		"sketch.ino.cpp": "void _setup(void) {}\nvoid _loop(void) {}\n",
+	}, map[string]string{})
+	for _, test := range []struct{ strip, localize bool }{{true, false}, {false, true}} {
+		err := hideObjects(context.Background(), target, "sketch", test.strip, test.localize, nil)
+		var ltoObjectsErr *LtoObjectsError
+		if !errors.As(err, &ltoObjectsErr) {
+			t.Errorf("strip=%v localize=%v: expected an LtoObjectsError, got %v", test.strip, test.localize, err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// PackageFormat is the format of the package containing the output of Precompile
+type PackageFormat string
+
+const (
+	// PackageNone doesn't create a package
+	PackageNone PackageFormat = ""
+	// PackageZip creates a .zip package
+	PackageZip PackageFormat = "zip"
+	// PackageTarGz creates a .tar.gz package
+	PackageTarGz PackageFormat = "tar.gz"
+)
+
+// packageEntry is a file or a directory to add to a package
+type packageEntry struct {
+	// name is the slash separated path inside the package, the directories end with a slash
+	name    string
+	content []byte
+	mode    os.FileMode
+	mtime   time.Time
+}
+
+// packagePath returns the path of the package of rootDir, it's next to rootDir
+func packagePath(rootDir *paths.Path, format PackageFormat) *paths.Path {
+	return rootDir.Parent().Join(rootDir.Base() + "." + string(format))
+}
+
+// createPackage creates the package of rootDir in the given format, the files and directories are inside a folder named like rootDir.
+// The library in libDir is added as a .zip, with the layout expected by the Arduino IDE "Add .ZIP Library":
+// all the files are inside a single folder named like the library. The package contains a SHA256SUMS file, in the sha256sum format,
+// with the hashes of all the files: the ones of the library are listed with the path they have once its .zip is extracted.
+// If the package already exists it's replaced, the previous one is moved aside in tx.
+// If deterministic is true the package only depends on the content of rootDir.
+func createPackage(tx *transaction, rootDir, libDir *paths.Path, format PackageFormat, deterministic bool) (*paths.Path, error) {
+	libEntries, err := readPackageEntries(libDir, libDir.Base()+"/", deterministic)
+	if err != nil {
+		return nil, err
+	}
+	libZip, err := createZip(libEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := readPackageEntries(rootDir, rootDir.Base()+"/", deterministic)
+	if err != nil {
+		return nil, err
+	}
+	mtime := time.Now()
+	if deterministic {
+		mtime = deterministicTime()
+	}
+	// the library is included only as a .zip
+	var packageEntries []*packageEntry
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.name, rootDir.Base()+"/"+libDir.Base()+"/") {
+			packageEntries = append(packageEntries, entry)
+		}
+	}
+	packageEntries = append(packageEntries, &packageEntry{
+		name:    rootDir.Base() + "/" + libDir.Base() + ".zip",
+		content: libZip,
+		mode:    0644,
+		mtime:   mtime,
+	})
+
+	// the hashes are the ones of the files in rootDir, so the SHA256SUMS can be checked on the extracted library too
+	sha256Sums := createSha256Sums(append(append([]*packageEntry{}, packageEntries...), libEntries...), rootDir.Base()+"/")
+	packageEntries = append(packageEntries, &packageEntry{
+		name:    rootDir.Base() + "/SHA256SUMS",
+		content: sha256Sums,
+		mode:    0644,
+		mtime:   mtime,
+	})
+	sort.SliceStable(packageEntries, func(i, j int) bool { return packageEntries[i].name < packageEntries[j].name })
+
+	var content []byte
+	switch format {
+	case PackageZip:
+		content, err = createZip(packageEntries)
+	case PackageTarGz:
+		content, err = createTarGz(packageEntries)
+	default:
+		err = &InvalidOptionsError{Reason: fmt.Sprintf("unknown package format %q", format)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pkgPath := packagePath(rootDir, format)
+	if pkgPath.Exist() {
+		backupDir, err := paths.MkTempDir(pkgPath.Parent().String(), ".arduino-cslt-backup-")
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.addTemporary(backupDir); err != nil {
+			return nil, err
+		}
+		if err = tx.moveAside(pkgPath, backupDir); err != nil {
+			return nil, err
+		}
+	} else if err = tx.addCreated(pkgPath); err != nil {
+		return nil, err
+	}
+	if err = pkgPath.WriteFile(content); err != nil {
+		return nil, err
+	}
+	if deterministic {
+		if err = pkgPath.Chtimes(mtime, mtime); err != nil {
+			return nil, err
+		}
+	}
+	logrus.Infof("created %s", pkgPath.String())
+	return pkgPath, nil
+}
+
+// createSha256Sums returns the content of a SHA256SUMS file, in the sha256sum format, listing the files among the entries
+// sorted by name. The names are relative to the folder prefix, the directories are skipped
+func createSha256Sums(entries []*packageEntry, prefix string) []byte {
+	var sha256Sums []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.name, "/") {
+			continue
+		}
+		name := strings.TrimPrefix(entry.name, prefix)
+		sha256Sums = append(sha256Sums, fmt.Sprintf("%x  %s\n", sha256.Sum256(entry.content), name))
+	}
+	sort.Slice(sha256Sums, func(i, j int) bool {
+		return sha256Sums[i][2*sha256.Size+2:] < sha256Sums[j][2*sha256.Size+2:]
+	})
+	return []byte(strings.Join(sha256Sums, ""))
+}
+
+// readPackageEntries returns the entries corresponding to dir and its content, their names start with prefix.
+// If deterministic is true the modes and the modification times are the ones set by normalizeFiles
+func readPackageEntries(dir *paths.Path, prefix string, deterministic bool) ([]*packageEntry, error) {
+	files, err := dir.ReadDirRecursive()
+	if err != nil {
+		return nil, err
+	}
+	files.Add(dir)
+	files.Sort()
+	var entries []*packageEntry
+	for _, file := range files {
+		relPath, err := file.RelFrom(dir)
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		entry := &packageEntry{
+			name:  path.Clean(prefix + filepath.ToSlash(relPath.String())),
+			mode:  info.Mode().Perm(),
+			mtime: info.ModTime(),
+		}
+		if deterministic {
+			entry.mode, entry.mtime = 0644, deterministicTime()
+		}
+		if info.IsDir() {
+			entry.name += "/"
+			entry.mode |= 0111 | os.ModeDir
+		} else if entry.content, err = file.ReadFile(); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// createZip returns a .zip containing the entries, in the given order
+func createZip(entries []*packageEntry) ([]byte, error) {
+	var buffer bytes.Buffer
+	zipWriter := zip.NewWriter(&buffer)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate, Modified: entry.mtime}
+		// the .zip format can't store dates before 1980
+		if minTime := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC); header.Modified.Before(minTime) {
+			header.Modified = minTime
+		}
+		header.SetMode(entry.mode)
+		if entry.mode.IsDir() {
+			header.Method = zip.Store
+		}
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(entry.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// createTarGz returns a .tar.gz containing the entries, in the given order. The owner is always root,
+// and the gzip header doesn't contain the name or the modification time
+func createTarGz(entries []*packageEntry) ([]byte, error) {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Mode:     int64(entry.mode.Perm()),
+			ModTime:  entry.mtime,
+			Size:     int64(len(entry.content)),
+			Typeflag: tar.TypeReg,
+		}
+		if entry.mode.IsDir() {
+			header.Typeflag = tar.TypeDir
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tarWriter.Write(entry.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPackageIndexFileName is the name of the index of the Arduino cores, it's always used by the arduino-cli
+const defaultPackageIndexFileName = "package_index.json"
+
+// packageIndexes finds the package index listing a platform, among the ones already downloaded by the arduino-cli in its data directory
+type packageIndexes struct {
+	dataDir string
+	// userUrls contains the URLs of the additional package indexes specified by the user
+	userUrls []string
+	// urls contains userUrls followed by the URLs in the arduino-cli config
+	urls []string
+	// platforms caches the platforms listed by the index files already read, as packager:architecture
+	platforms map[string]map[string]bool
+}
+
+// newPackageIndexes returns the package indexes in the arduino-cli config, together with the ones in additionalUrls
+func newPackageIndexes(config *cliConfig, additionalUrls []string) *packageIndexes {
+	urls := append([]string{}, additionalUrls...)
+	for _, configUrl := range config.BoardManager.AdditionalUrls {
+		urls = appendIfMissing(urls, configUrl)
+	}
+	return &packageIndexes{
+		dataDir:   config.Directories.Data,
+		userUrls:  additionalUrls,
+		urls:      urls,
+		platforms: map[string]map[string]bool{},
+	}
+}
+
+// indexUrl returns the URL of the additional package index listing the platform with the given id (packager:architecture),
+// it's empty if the platform is listed in the index of the Arduino cores or if it cannot be found.
+// If the platform is not listed in any index downloaded and a single URL has been specified by the user, that URL is returned.
+// Only the http and https URLs are returned: a local index (e.g. file:///home/user/package_index.json) cannot be used
+// by whoever receives the library, and its path must not end up in the README.md
+func (p *packageIndexes) indexUrl(platformId string) string {
+	if strings.HasPrefix(platformId, "arduino:") || p.lists(p.indexPath(defaultPackageIndexFileName), platformId) {
+		return ""
+	}
+	for _, indexUrl := range p.urls {
+		if p.lists(p.indexPath(indexUrl), platformId) {
+			logrus.Infof("found %s in the package index %s", platformId, indexUrl)
+			return remoteIndexUrl(platformId, indexUrl)
+		}
+	}
+	if len(p.userUrls) == 1 {
+		logrus.Warnf("cannot find %s in the package indexes downloaded, assuming it's listed in %s", platformId, p.userUrls[0])
+		return remoteIndexUrl(platformId, p.userUrls[0])
+	}
+	logrus.Warnf("cannot find the package index listing %s, the README.md will not contain its URL: specify it with --additional-urls", platformId)
+	return ""
+}
+
+// remoteIndexUrl returns indexUrl if it's an http or https URL, otherwise it warns that the platform
+// cannot be installed following the README.md and it returns an empty string
+func remoteIndexUrl(platformId, indexUrl string) string {
+	if parsedUrl, err := url.Parse(indexUrl); err == nil && (parsedUrl.Scheme == "http" || parsedUrl.Scheme == "https") && parsedUrl.Host != "" {
+		return indexUrl
+	}
+	logrus.Warnf("the package index listing %s is not an http or https URL, the README.md will not contain it and the core cannot be installed following it", platformId)
+	return ""
+}
+
+// indexPath returns the path of the package index downloaded from indexUrl, the arduino-cli saves it in its data directory
+// with the name of the file in the URL. The file:// URLs point to a local index, that is not copied
+func (p *packageIndexes) indexPath(indexUrl string) *paths.Path {
+	parsedUrl, err := url.Parse(indexUrl)
+	if err != nil {
+		return nil
+	} else if parsedUrl.Scheme == "file" {
+		return paths.New(parsedUrl.Path)
+	} else if p.dataDir == "" {
+		return nil
+	}
+	// the compressed indexes are saved decompressed
+	return paths.New(p.dataDir, strings.TrimSuffix(path.Base(parsedUrl.Path), ".gz"))
+}
+
+// lists returns true if the package index in indexPath lists the platform with the given id (packager:architecture)
+func (p *packageIndexes) lists(indexPath *paths.Path, platformId string) bool {
+	if indexPath == nil {
+		return false
+	}
+	platforms, ok := p.platforms[indexPath.String()]
+	if !ok {
+		platforms = map[string]bool{}
+		p.platforms[indexPath.String()] = platforms
+		content, err := indexPath.ReadFile()
+		if err != nil {
+			logrus.Infof("cannot read the package index %s: %s", indexPath.String(), err)
+			return false
+		}
+		var index struct {
+			Packages []struct {
+				Name      string `json:"name"`
+				Platforms []struct {
+					Architecture string `json:"architecture"`
+				} `json:"platforms"`
+			} `json:"packages"`
+		}
+		if err := json.Unmarshal(content, &index); err != nil {
+			logrus.Warnf("cannot parse the package index %s: %s", indexPath.String(), err)
+			return false
+		}
+		for _, pkg := range index.Packages {
+			for _, platform := range pkg.Platforms {
+				platforms[pkg.Name+":"+platform.Architecture] = true
+			}
+		}
+	}
+	return platforms[platformId]
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+func TestIndexUrl(t *testing.T) {
+	dataDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataDir.RemoveAll()
+	for name, content := range map[string]string{
+		"package_index.json":            `{"packages":[{"name":"arduino","platforms":[{"architecture":"avr"}]},{"name":"Intel","platforms":[{"architecture":"arc32"}]}]}`,
+		"package_esp32_index.json":      `{"packages":[{"name":"esp32","platforms":[{"architecture":"esp32"}]}]}`,
+		"package_adafruit_index.json":   `{"packages":[{"name":"adafruit","platforms":[{"architecture":"samd"},{"architecture":"nrf52"}]}]}`,
+		"local/package_acme_index.json": `{"packages":[{"name":"acme","platforms":[{"architecture":"avr"}]}]}`,
+		"package_broken_index.json":     `{"packages":`,
+	} {
+		path := dataDir.Join(name)
+		path.Parent().MkdirAll()
+		if err := path.WriteFile([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	esp32Url := "https://espressif.github.io/arduino-esp32/package_esp32_index.json"
+	adafruitUrl := "https://adafruit.github.io/arduino-board-index/package_adafruit_index.json.gz"
+	acmeUrl := "file://" + dataDir.Join("local", "package_acme_index.json").String()
+	brokenUrl := "https://example.com/package_broken_index.json"
+	otherUrl := "https://example.com/package_other_index.json"
+
+	for _, test := range []struct {
+		name           string
+		platformId     string
+		configUrls     []string
+		additionalUrls []string
+		expected       string
+	}{
+		{"arduino core", "arduino:avr", []string{esp32Url}, nil, ""},
+		{"listed by the default index", "Intel:arc32", []string{esp32Url}, nil, ""},
+		{"config url", "esp32:esp32", []string{adafruitUrl, esp32Url}, nil, esp32Url},
+		{"compressed index", "adafruit:nrf52", []string{esp32Url, adafruitUrl}, nil, adafruitUrl},
+		{"additional url", "adafruit:samd", nil, []string{esp32Url, adafruitUrl}, adafruitUrl},
+		// the local indexes are read, but their path is not recorded
+		{"local index", "acme:avr", nil, []string{brokenUrl, acmeUrl}, ""},
+		{"single local additional url", "other:avr", nil, []string{"/home/user/package_other_index.json"}, ""},
+		// the index of the single additional URL has not been downloaded yet
+		{"single additional url", "other:avr", []string{esp32Url}, []string{otherUrl}, otherUrl},
+		{"not found", "other:avr", []string{esp32Url}, []string{otherUrl, adafruitUrl}, ""},
+	} {
+		config := &cliConfig{}
+		config.Directories.Data = dataDir.String()
+		config.BoardManager.AdditionalUrls = test.configUrls
+		if indexUrl := newPackageIndexes(config, test.additionalUrls).indexUrl(test.platformId); indexUrl != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, indexUrl, test.expected)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import "testing"
+
+func TestCreateSha256Sums(t *testing.T) {
+	entries := []*packageEntry{
+		{name: "sketch-dist/"},
+		{name: "sketch-dist/sketch/sketch.ino", content: []byte("void setup() {}\n")},
+		{name: "sketch-dist/README.md", content: []byte("")},
+		{name: "sketch-dist/libsketch.zip", content: []byte("abc")},
+		{name: "libsketch/"},
+		{name: "libsketch/library.properties", content: []byte("name=sketch\n")},
+		{name: "libsketch/src/"},
+		{name: "libsketch/src/cortex-m0plus/libsketch.a", content: []byte("!<arch>\n")},
+	}
+	// the directories are skipped, the names are relative to the package folder and sorted
+	expected := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  README.md\n" +
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad  libsketch.zip\n" +
+		"c593287c6bcaa54e888984e772aa8414e6d9868fa150859ee4ab488b6eef04f5  libsketch/library.properties\n" +
+		"f0a17a43c74d2fe5474fa2fd29c8f14799e777d7d75a2cc4d11c20a6e7b161c5  libsketch/src/cortex-m0plus/libsketch.a\n" +
+		"af4b7c66d238ecec0938570410716001c3029a97743e83e52fe022b22df43683  sketch/sketch.ino\n"
+	if sums := string(createSha256Sums(entries, "sketch-dist/")); sums != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", sums, expected)
+	}
+}
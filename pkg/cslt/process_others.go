@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+
+package cslt
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// isProcessRunning returns true if the process with the given pid is running:
+// os.FindProcess always succeeds, the signal 0 checks if the process exists.
+// Only ESRCH means that the process is gone: with EPERM it exists, but it belongs to another user
+func isProcessRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+
+package cslt
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	// processQueryLimitedInformation is the PROCESS_QUERY_LIMITED_INFORMATION access right
+	processQueryLimitedInformation = 0x1000
+	// stillActive is the exit code of the processes still running (STILL_ACTIVE)
+	stillActive = 259
+)
+
+// isProcessRunning returns true if the process with the given pid is running: the handle of an exited process
+// can still be opened while another process holds it, so the exit code is checked too.
+// A process that cannot be opened because of the permissions is considered running
+func isProcessRunning(pid int) bool {
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if errors.Is(err, syscall.ERROR_ACCESS_DENIED) {
+		return true
+	} else if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+	var exitCode uint32
+	if err := syscall.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return false
+	}
+	return exitCode == stillActive
+}
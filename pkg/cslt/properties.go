@@ -0,0 +1,74 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// properties is a set of key=value pairs, as found in the Arduino .properties files, that keeps the order of the keys
+type properties struct {
+	keys   []string
+	values map[string]string
+}
+
+// parseProperties parses content, the lines are in the key=value format:
+// empty lines and the ones starting with # are skipped, keys and values are trimmed.
+// If a key is repeated the last value wins, but the key keeps the position of its first occurrence
+func parseProperties(content []byte) (*properties, error) {
+	props := &properties{values: map[string]string{}}
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.Index(line, "=")
+		if separator == -1 {
+			return nil, fmt.Errorf("invalid line %d: %q, it should be key=value", i+1, line)
+		}
+		props.set(strings.TrimSpace(line[:separator]), strings.TrimSpace(line[separator+1:]))
+	}
+	return props, nil
+}
+
+// set sets the value of key, new keys are appended to the end
+func (p *properties) set(key, value string) {
+	if _, ok := p.values[key]; !ok {
+		p.keys = append(p.keys, key)
+	}
+	p.values[key] = value
+}
+
+// get returns the value of key and true, or an empty string and false if key is missing
+func (p *properties) get(key string) (string, bool) {
+	value, ok := p.values[key]
+	return value, ok
+}
+
+// expandPropsRegexp matches the {key} placeholders in a property value
+var expandPropsRegexp = regexp.MustCompile(`\{[^{}]+\}`)
+
+// expand replaces the {key} placeholders in value with the values of the corresponding keys, recursively.
+// The placeholders of the missing keys are left untouched, like the arduino-cli does
+func (p *properties) expand(value string) string {
+	// the depth is limited, a property could reference itself
+	for i := 0; i < 10; i++ {
+		expanded := expandPropsRegexp.ReplaceAllStringFunc(value, func(placeholder string) string {
+			if v, ok := p.get(placeholder[1 : len(placeholder)-1]); ok {
+				return v
+			}
+			return placeholder
+		})
+		if expanded == value {
+			break
+		}
+		value = expanded
+	}
+	return value
+}
@@ -0,0 +1,100 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProperties(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		keys    []string
+		values  map[string]string
+		err     string
+	}{
+		{
+			name:    "simple",
+			content: "name=Foo\nversion=1.0.0\n",
+			keys:    []string{"name", "version"},
+			values:  map[string]string{"name": "Foo", "version": "1.0.0"},
+		},
+		{
+			name:    "comments, empty lines and spaces",
+			content: "# comment\n\n  name = Foo Bar  \r\n\t# another=comment\nempty=\n",
+			keys:    []string{"name", "empty"},
+			values:  map[string]string{"name": "Foo Bar", "empty": ""},
+		},
+		{
+			name:    "separator in the value",
+			content: "recipe=a=b {c}\n",
+			keys:    []string{"recipe"},
+			values:  map[string]string{"recipe": "a=b {c}"},
+		},
+		{
+			name:    "repeated key",
+			content: "a=1\nb=2\na=3\n",
+			keys:    []string{"a", "b"},
+			values:  map[string]string{"a": "3", "b": "2"},
+		},
+		{
+			name:    "invalid line",
+			content: "a=1\nnot a property\n",
+			err:     `invalid line 2: "not a property"`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			props, err := parseProperties([]byte(test.content))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(props.keys, ",") != strings.Join(test.keys, ",") {
+				t.Errorf("keys are %v, expected %v", props.keys, test.keys)
+			}
+			for key, expected := range test.values {
+				if value, ok := props.get(key); !ok || value != expected {
+					t.Errorf("%s is %q (%v), expected %q", key, value, ok, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestPropertiesExpand(t *testing.T) {
+	props, err := parseProperties([]byte(`runtime.tools.avr-gcc.path=/tools/avr-gcc
+compiler.path={runtime.tools.avr-gcc.path}/bin/
+compiler.c.elf.cmd=avr-gcc
+cmd={compiler.path}{compiler.c.elf.cmd}
+self={self}
+a={b}
+b={a}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		value    string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"{compiler.c.elf.cmd}", "avr-gcc"},
+		{"{cmd} -o {build.path}", "/tools/avr-gcc/bin/avr-gcc -o {build.path}"},
+		{"{missing} {}", "{missing} {}"},
+		{"{self}", "{self}"},
+		{"{a}", "{a}"},
+	} {
+		if expanded := props.expand(test.value); expanded != test.expected {
+			t.Errorf("%q expands to %q, expected %q", test.value, expanded, test.expected)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// Repair restores the sketch in sketchPath left patched by an interrupted run:
+// it removes the temporary files and the partial output listed in the journals of the interrupted runs
+// (the output of the runs interrupted after being committed is kept),
+// restores the original content of the .ino file, where setup() and loop() have been renamed to _setup() and _loop(),
+// and removes the main.cpp generated by the tool. A main.cpp not generated by the tool is never removed.
+// It returns true if something has been repaired
+func Repair(sketchPath string) (bool, error) {
+	inoPath, err := getInoSketchPath(sketchPath)
+	if err != nil {
+		return false, err
+	}
+	absInoPath, err := inoPath.Abs()
+	if err != nil {
+		return false, err
+	}
+	journals, err := findJournals(absInoPath)
+	if err != nil {
+		return false, err
+	}
+	repaired := len(journals) > 0
+
+	// the interrupted runs could have left behind their staging directory and a partial output,
+	// the previous output is moved back before removing the temporary directories, the backups are inside them
+	for _, j := range journals {
+		logrus.Infof("found journal %s of the run started at %s", j.path.String(), j.StartedAt)
+		// a committed run has been interrupted while cleaning up: its output is complete and must be kept
+		if !j.Committed {
+			if err := removeAll(j.Created); err != nil {
+				return repaired, fmt.Errorf("cannot remove the files listed in %s: %s", j.path.String(), err)
+			}
+			if err := restoreAll(j.Replaced); err != nil {
+				return repaired, fmt.Errorf("cannot restore the files listed in %s: %s", j.path.String(), err)
+			}
+		}
+		if err := removeAll(j.Temporary); err != nil {
+			return repaired, fmt.Errorf("cannot remove the files listed in %s: %s", j.path.String(), err)
+		}
+	}
+
+	inoContent, err := absInoPath.ReadFile()
+	if err != nil {
+		return repaired, err
+	}
+	if isPatched(inoContent) {
+		// the sketch is patched in the staging directory, so a patched .ino has been left by an older version of the tool
+		// and the backups in the journals of the later runs are patched too: only the most recent unpatched backup can be used
+		var originalContent []byte
+		for i := len(journals) - 1; i >= 0; i-- {
+			if len(journals[i].InoContent) > 0 && !isPatched(journals[i].InoContent) {
+				originalContent = journals[i].InoContent
+				break
+			}
+		}
+		if originalContent == nil {
+			// without a backup we revert the patch done by older versions of the tool,
+			// they replaced every "void setup()" with "void _setup()" and every "void loop()" with "void _loop()"
+			originalContent = bytes.Replace(inoContent, []byte("void _setup()"), []byte("void setup()"), -1)
+			originalContent = bytes.Replace(originalContent, []byte("void _loop()"), []byte("void loop()"), -1)
+		}
+		if err := absInoPath.WriteFile(originalContent); err != nil {
+			return repaired, err
+		}
+		logrus.Infof("restored %s", inoPath.String())
+		repaired = true
+	}
+
+	// older versions of the tool generated a main.cpp in the sketch directory
+	for _, mainCppName := range []string{"main.cpp", mainCppFileName} {
+		mainCppPath := absInoPath.Parent().Join(mainCppName)
+		if mainCppPath.NotExist() {
+			continue
+		}
+		mainCppContent, err := mainCppPath.ReadFile()
+		if err != nil {
+			return repaired, err
+		}
+		if !isGeneratedMainCpp(mainCppContent) {
+			logrus.Warnf("%s has not been generated by arduino-cslt, leaving it untouched", mainCppPath.String())
+			continue
+		}
+		if err := mainCppPath.Remove(); err != nil {
+			return repaired, err
+		}
+		logrus.Infof("removed %s", mainCppPath.String())
+		repaired = true
+	}
+
+	// the journals are removed last, this way the repair can be run again if something goes wrong
+	for _, j := range journals {
+		if err := j.path.Remove(); err != nil {
+			return repaired, err
+		}
+		logrus.Infof("removed %s", j.path.String())
+	}
+	return repaired, nil
+}
+
+// journalFile is a journal read from disk
+type journalFile struct {
+	journal
+	path *paths.Path
+}
+
+// findJournals returns the journals of the interrupted runs on the sketch whose main file is absInoPath, the oldest first.
+// The journals of the runs still in progress are skipped
+func findJournals(absInoPath *paths.Path) ([]*journalFile, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+	if dir.NotExist() {
+		return nil, nil
+	}
+	files, err := dir.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+	files.FilterOutSuffix(".tmp")
+	var journals []*journalFile
+	for _, file := range files {
+		content, err := file.ReadFile()
+		if err != nil {
+			return nil, err
+		}
+		j := &journalFile{path: file}
+		if err := json.Unmarshal(content, &j.journal); err != nil {
+			logrus.Warnf("skipping invalid journal %s: %s", file.String(), err)
+			continue
+		}
+		if j.InoPath != absInoPath.String() {
+			continue
+		}
+		if j.Pid != os.Getpid() && isProcessRunning(j.Pid) {
+			logrus.Warnf("skipping journal %s, the run is still in progress (pid %d)", file.String(), j.Pid)
+			continue
+		}
+		journals = append(journals, j)
+	}
+	sort.Slice(journals, func(i, j int) bool { return journals[i].StartedAt.Before(journals[j].StartedAt) })
+	return journals, nil
+}
+
+// isPatched returns true if the sketch content defines _setup() and _loop() instead of setup() and loop()
+func isPatched(inoContent []byte) bool {
+	tokens := tokenizeSketch(inoContent)
+	return len(findFunctionDefinitions(tokens, "_setup")) > 0 && len(findFunctionDefinitions(tokens, "setup")) == 0 &&
+		len(findFunctionDefinitions(tokens, "_loop")) > 0 && len(findFunctionDefinitions(tokens, "loop")) == 0
+}
+
+// isGeneratedMainCpp returns true if content is the one of the main.cpp generated by the tool,
+// line endings are ignored because the file could have been converted by git
+func isGeneratedMainCpp(content []byte) bool {
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	return string(bytes.TrimSpace(content)) == mainCppContent
+}
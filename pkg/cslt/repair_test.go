@@ -0,0 +1,92 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+func TestRepairCommittedJournal(t *testing.T) {
+	tmpDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpDir.RemoveAll()
+	// the journals are written in the user cache dir
+	t.Setenv("XDG_CACHE_HOME", tmpDir.Join("cache").String())
+	t.Setenv("HOME", tmpDir.String())
+	journalsDir, err := journalDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journalsDir.MkdirAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	inoContent := []byte("void setup() {}\nvoid loop() {}\n")
+	for _, test := range []struct {
+		name      string
+		committed bool
+	}{
+		{"committed", true},
+		{"not committed", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sketchDir := tmpDir.Join(test.name, "sketch")
+			output := tmpDir.Join(test.name, "sketch-dist")
+			staging := tmpDir.Join(test.name, "staging")
+			for _, dir := range []*paths.Path{sketchDir, output, staging} {
+				if err := dir.MkdirAll(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			inoPath := sketchDir.Join("sketch.ino")
+			if err := inoPath.WriteFile(inoContent); err != nil {
+				t.Fatal(err)
+			}
+
+			// the run has been killed while removing the temporary files, before removing the journal
+			j := &journal{
+				Pid:        os.Getpid(),
+				StartedAt:  time.Now(),
+				InoPath:    inoPath.String(),
+				InoContent: inoContent,
+				Temporary:  []string{staging.String()},
+				Created:    []string{output.String()},
+				Committed:  test.committed,
+			}
+			content, err := json.Marshal(j)
+			if err != nil {
+				t.Fatal(err)
+			}
+			journalPath := journalsDir.Join("journal-test")
+			if err := journalPath.WriteFile(content); err != nil {
+				t.Fatal(err)
+			}
+
+			repaired, err := Repair(sketchDir.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !repaired {
+				t.Error("expected the sketch to be repaired")
+			}
+			if output.Exist() != test.committed {
+				t.Errorf("output exists: %t, expected %t", output.Exist(), test.committed)
+			}
+			if staging.Exist() {
+				t.Error("the temporary files have not been removed")
+			}
+			if journalPath.Exist() {
+				t.Error("the journal has not been removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// SBOMFormat is the format of the Software Bill of Materials describing the precompiled library
+type SBOMFormat string
+
+const (
+	// SBOMNone doesn't create a SBOM
+	SBOMNone SBOMFormat = ""
+	// SBOMSpdx creates a SPDX 2.3 SBOM, in JSON
+	SBOMSpdx SBOMFormat = "spdx"
+	// SBOMCycloneDX creates a CycloneDX 1.4 SBOM, in JSON
+	SBOMCycloneDX SBOMFormat = "cyclonedx"
+)
+
+// sbomFormats contains all the SBOM formats supported
+var sbomFormats = []SBOMFormat{SBOMSpdx, SBOMCycloneDX}
+
+// sbomComponent is a component of the precompiled library described by the SBOM: the library itself, a core or a library it uses
+type sbomComponent struct {
+	// ref is a unique identifier of the component inside the SBOM
+	ref string
+	// platform is true if the component is a core
+	platform bool
+	name     string
+	version  string
+	// license is the license as declared by the component, it's empty if unknown
+	license string
+	// author is the author as declared by the component, it's empty if unknown
+	author string
+}
+
+// sbomRefRegexp matches the characters that cannot be used in a reference, SPDX only allows letters, numbers, "." and "-"
+var sbomRefRegexp = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// spdxIdRegexp matches a license or an exception identifier of a SPDX license expression, e.g. "MIT", "GPL-2.0+" or "LicenseRef-Custom"
+var spdxIdRegexp = regexp.MustCompile(`^[A-Za-z0-9.\-]+\+?$`)
+
+// isSpdxExpression returns true if license is a valid SPDX license expression, e.g. "MIT" or "(LGPL-2.1-or-later OR MIT) AND BSD-3-Clause".
+// Only the syntax is checked, the identifiers are not looked up in the SPDX license list
+func isSpdxExpression(license string) bool {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(license))
+	// expectId is true when a license, an exception or an open parenthesis is expected, afterWith when it must be an exception
+	expectId, afterWith, afterLicense := true, false, false
+	depth := 0
+	for _, tok := range tokens {
+		isOperator := tok == "AND" || tok == "OR" || tok == "WITH"
+		switch {
+		case expectId && tok == "(" && !afterWith:
+			depth++
+		case expectId && !isOperator && tok != ")" && spdxIdRegexp.MatchString(tok):
+			expectId, afterLicense, afterWith = false, !afterWith, false
+		case !expectId && tok == ")" && depth > 0:
+			depth--
+			afterLicense = false
+		case !expectId && (tok == "AND" || tok == "OR"):
+			expectId = true
+		case !expectId && tok == "WITH" && afterLicense:
+			expectId, afterWith = true, true
+		default:
+			return false
+		}
+	}
+	return len(tokens) > 0 && !expectId && depth == 0
+}
+
+// sbomPath returns the path of the SBOM in the given format inside the extras folder of the library
+func sbomPath(extraDir *paths.Path, format SBOMFormat) *paths.Path {
+	return extraDir.Join("sbom." + string(format) + ".json")
+}
+
+// sbomComponents returns the library described by libProps and the cores and libraries used to compile it for the targets,
+// every component is listed once, the cores first
+func sbomComponents(libProps *LibraryProperties, targets []*Target) (*sbomComponent, []*sbomComponent) {
+	lib := &sbomComponent{
+		ref:     "Library-" + sbomRefRegexp.ReplaceAllString(libProps.Name, "-"),
+		name:    libProps.Name,
+		version: libProps.Version,
+		license: libProps.License,
+		author:  libProps.Author,
+	}
+	var components []*sbomComponent
+	refs := map[string]bool{lib.ref: true}
+	add := func(component *sbomComponent) {
+		component.ref += "-" + sbomRefRegexp.ReplaceAllString(component.name+"-"+component.version, "-")
+		if !refs[component.ref] {
+			refs[component.ref] = true
+			components = append(components, component)
+		}
+	}
+	for _, component := range thirdPartyComponents(targets) {
+		ref := "Library"
+		if component.platform {
+			ref = "Platform"
+		}
+		add(&sbomComponent{ref: ref, platform: component.platform, name: component.name, version: component.version, license: component.license})
+	}
+	return lib, components
+}
+
+// sbomSerial returns a UUID identifying the SBOM of lib, it only depends on the components and on the creation time
+func sbomSerial(lib *sbomComponent, components []*sbomComponent, created time.Time) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", created.Format(time.RFC3339))
+	for _, component := range append([]*sbomComponent{lib}, components...) {
+		fmt.Fprintf(hash, "%s %s %s\n", component.ref, component.version, component.license)
+	}
+	uuid := hash.Sum(nil)[:16]
+	// it's a random UUID (version 4), as far as the readers are concerned
+	uuid[6], uuid[8] = uuid[6]&0x0f|0x40, uuid[8]&0x3f|0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// createSbomFile writes the SBOM of the library described by libProps, compiled for targets, in path.
+// The SBOM contains the library, the cores and the libraries used, with their versions and licenses if declared.
+// created is the creation time recorded in the SBOM
+func createSbomFile(path *paths.Path, format SBOMFormat, libProps *LibraryProperties, targets []*Target, created time.Time) error {
+	lib, components := sbomComponents(libProps, targets)
+	serial := sbomSerial(lib, components, created)
+	var sbom interface{}
+	switch format {
+	case SBOMSpdx:
+		sbom = newSpdxDocument(lib, components, serial, created)
+	case SBOMCycloneDX:
+		sbom = newCycloneDXBom(lib, components, serial, created)
+	default:
+		return &InvalidOptionsError{Reason: fmt.Sprintf("unknown SBOM format %q", format)}
+	}
+	if content, err := json.MarshalIndent(sbom, "", " "); err != nil {
+		return fmt.Errorf("error serializing json: %s", err)
+	} else if err := path.WriteFile(content); err != nil {
+		return fmt.Errorf("error writing %s: %s", path.Base(), err)
+	}
+	logrus.Infof("created %s", path.String())
+	return nil
+}
+
+// spdxDocument is a SPDX 2.3 document, see https://spdx.github.io/spdx-spec/v2.3/
+type spdxDocument struct {
+	SpdxVersion       string              `json:"spdxVersion"`
+	DataLicense       string              `json:"dataLicense"`
+	SpdxId            string              `json:"SPDXID"`
+	Name              string              `json:"name"`
+	DocumentNamespace string              `json:"documentNamespace"`
+	CreationInfo      *spdxCreationInfo   `json:"creationInfo"`
+	Packages          []*spdxPackage      `json:"packages"`
+	Relationships     []*spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string `json:"name"`
+	SpdxId           string `json:"SPDXID"`
+	VersionInfo      string `json:"versionInfo,omitempty"`
+	Originator       string `json:"originator,omitempty"`
+	DownloadLocation string `json:"downloadLocation"`
+	FilesAnalyzed    bool   `json:"filesAnalyzed"`
+	LicenseConcluded string `json:"licenseConcluded"`
+	LicenseDeclared  string `json:"licenseDeclared"`
+	CopyrightText    string `json:"copyrightText"`
+	Comment          string `json:"comment,omitempty"`
+}
+
+type spdxRelationship struct {
+	SpdxElementId      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSpdxElement string `json:"relatedSpdxElement"`
+}
+
+// newSpdxDocument returns the SPDX document describing lib, it depends on the components
+func newSpdxDocument(lib *sbomComponent, components []*sbomComponent, serial string, created time.Time) *spdxDocument {
+	doc := &spdxDocument{
+		SpdxVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SpdxId:            "SPDXRef-DOCUMENT",
+		Name:              lib.name + "-" + lib.version,
+		DocumentNamespace: "https://spdx.org/spdxdocs/" + sbomRefRegexp.ReplaceAllString(lib.name, "-") + "-" + serial,
+		CreationInfo: &spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: arduino-cslt"},
+		},
+		Relationships: []*spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-" + lib.ref}},
+	}
+	for _, component := range append([]*sbomComponent{lib}, components...) {
+		pkg := &spdxPackage{
+			Name:             component.name,
+			SpdxId:           "SPDXRef-" + component.ref,
+			VersionInfo:      component.version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}
+		if component.author != "" {
+			pkg.Originator = "Person: " + component.author
+		}
+		var comments []string
+		if component.platform {
+			comments = append(comments, "Arduino platform (core)")
+		}
+		// the licenses that are not SPDX expressions (e.g. "Custom License") are kept as a comment
+		if isSpdxExpression(component.license) {
+			pkg.LicenseDeclared = component.license
+		} else if component.license != "" {
+			comments = append(comments, "declared license: "+component.license)
+		}
+		pkg.Comment = strings.Join(comments, ", ")
+		doc.Packages = append(doc.Packages, pkg)
+		if component != lib {
+			doc.Relationships = append(doc.Relationships, &spdxRelationship{"SPDXRef-" + lib.ref, "DEPENDS_ON", pkg.SpdxId})
+		}
+	}
+	return doc
+}
+
+// cycloneDXBom is a CycloneDX 1.4 BOM, see https://cyclonedx.org/docs/1.4/json/
+type cycloneDXBom struct {
+	BomFormat    string                 `json:"bomFormat"`
+	SpecVersion  string                 `json:"specVersion"`
+	SerialNumber string                 `json:"serialNumber"`
+	Version      int                    `json:"version"`
+	Metadata     *cycloneDXMetadata     `json:"metadata"`
+	Components   []*cycloneDXComponent  `json:"components"`
+	Dependencies []*cycloneDXDependency `json:"dependencies"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string              `json:"timestamp"`
+	Tools     []*cycloneDXTool    `json:"tools"`
+	Component *cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Name string `json:"name"`
+}
+
+type cycloneDXComponent struct {
+	Type     string              `json:"type"`
+	BomRef   string              `json:"bom-ref"`
+	Author   string              `json:"author,omitempty"`
+	Name     string              `json:"name"`
+	Version  string              `json:"version,omitempty"`
+	Licenses []*cycloneDXLicense `json:"licenses,omitempty"`
+}
+
+// cycloneDXLicense contains a license expression or, if the license is not a SPDX one, its name
+type cycloneDXLicense struct {
+	Expression string                `json:"expression,omitempty"`
+	License    *cycloneDXLicenseName `json:"license,omitempty"`
+}
+
+type cycloneDXLicenseName struct {
+	Name string `json:"name"`
+}
+
+type cycloneDXDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// newCycloneDXBom returns the CycloneDX BOM describing lib, it depends on the components
+func newCycloneDXBom(lib *sbomComponent, components []*sbomComponent, serial string, created time.Time) *cycloneDXBom {
+	bom := &cycloneDXBom{
+		BomFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + serial,
+		Version:      1,
+		Metadata: &cycloneDXMetadata{
+			Timestamp: created.UTC().Format(time.RFC3339),
+			Tools:     []*cycloneDXTool{{Name: "arduino-cslt"}},
+			Component: newCycloneDXComponent(lib),
+		},
+		Components: []*cycloneDXComponent{},
+	}
+	libDependency := &cycloneDXDependency{Ref: lib.ref}
+	bom.Dependencies = append(bom.Dependencies, libDependency)
+	for _, component := range components {
+		bom.Components = append(bom.Components, newCycloneDXComponent(component))
+		libDependency.DependsOn = append(libDependency.DependsOn, component.ref)
+		bom.Dependencies = append(bom.Dependencies, &cycloneDXDependency{Ref: component.ref})
+	}
+	return bom
+}
+
+// newCycloneDXComponent returns the CycloneDX component corresponding to component, the cores are frameworks
+func newCycloneDXComponent(component *sbomComponent) *cycloneDXComponent {
+	res := &cycloneDXComponent{Type: "library", BomRef: component.ref, Author: component.author, Name: component.name, Version: component.version}
+	if component.platform {
+		res.Type = "framework"
+	}
+	if isSpdxExpression(component.license) {
+		res.Licenses = []*cycloneDXLicense{{Expression: component.license}}
+	} else if component.license != "" {
+		res.Licenses = []*cycloneDXLicense{{License: &cycloneDXLicenseName{Name: component.license}}}
+	}
+	return res
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsSpdxExpression(t *testing.T) {
+	for license, expected := range map[string]bool{
+		"MIT":                                   true,
+		"GPL-2.0+":                              true,
+		"LicenseRef-Custom":                     true,
+		"LGPL-2.1-or-later OR MIT":              true,
+		"(MIT OR Apache-2.0) AND GPL-3.0-only":  true,
+		"((MIT))":                               true,
+		"GPL-3.0-only WITH GCC-exception-3.1":   true,
+		"(GPL-3.0-only WITH GCC-exception-3.1)": true,
+		"":                                      false,
+		"Custom License":                        false,
+		"MIT OR":                                false,
+		"AND MIT":                               false,
+		"(MIT":                                  false,
+		"MIT)":                                  false,
+		"()":                                    false,
+		"MIT WITH":                              false,
+		"MIT WITH A WITH B":                     false,
+		"(MIT OR BSD-3-Clause) WITH A":          false,
+		"Apache 2.0":                            false,
+		"MIT/X11":                               false,
+	} {
+		if isSpdxExpression(license) != expected {
+			t.Errorf("isSpdxExpression(%q) is %v, expected %v", license, !expected, expected)
+		}
+	}
+}
+
+func TestNewSpdxDocumentLicenses(t *testing.T) {
+	lib := &sbomComponent{ref: "lib", name: "sketch", version: "1.0.0", license: "MIT"}
+	doc := newSpdxDocument(lib, []*sbomComponent{
+		{ref: "core", name: "arduino:samd", version: "1.8.12", license: "Custom License", platform: true},
+		{ref: "spi", name: "SPI", version: "1.0", license: "LGPL-2.1-or-later"},
+		{ref: "foo", name: "Foo", version: "2.0.1"},
+	}, "serial", time.Unix(0, 0))
+	for i, expected := range []struct{ licenseDeclared, comment string }{
+		{"MIT", ""},
+		{"NOASSERTION", "Arduino platform (core), declared license: Custom License"},
+		{"LGPL-2.1-or-later", ""},
+		{"NOASSERTION", ""},
+	} {
+		pkg := doc.Packages[i]
+		if pkg.LicenseDeclared != expected.licenseDeclared || pkg.Comment != expected.comment {
+			t.Errorf("%s: licenseDeclared=%q comment=%q, expected %q and %q", pkg.Name, pkg.LicenseDeclared, pkg.Comment, expected.licenseDeclared, expected.comment)
+		}
+	}
+}
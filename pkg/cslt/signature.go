@@ -0,0 +1,172 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// signatureSuffix is appended to the name of a signed file to get the name of its detached signature
+const signatureSuffix = ".sig"
+
+// SignatureReport contains the outcome of the verification of the signature of a single file
+type SignatureReport struct {
+	// Path is the path of the signed file
+	Path string
+	// Problem describes why the signature is not valid, it's empty if the signature is valid
+	Problem string
+}
+
+// Valid returns true if the file has a valid signature
+func (r *SignatureReport) Valid() bool {
+	return r.Problem == ""
+}
+
+// LoadPrivateKey reads an ed25519 private key from the PEM file in path, in the PKCS #8 format,
+// e.g. the one created by `openssl genpkey -algorithm ed25519`
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPemFile(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, &KeyError{Path: path, Err: err}
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, &KeyError{Path: path, Err: err}
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, &KeyError{Path: path, Err: errors.New("it's not an ed25519 key")}
+	}
+	return privateKey, nil
+}
+
+// LoadPublicKey reads an ed25519 public key from the PEM file in path, in the PKIX format,
+// e.g. the one created by `openssl pkey -pubout`
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPemFile(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, &KeyError{Path: path, Err: err}
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, &KeyError{Path: path, Err: err}
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, &KeyError{Path: path, Err: errors.New("it's not an ed25519 key")}
+	}
+	return publicKey, nil
+}
+
+// readPemFile returns the content of the first PEM block of the file in path, the block must be of blockType
+func readPemFile(path, blockType string) ([]byte, error) {
+	content, err := paths.New(path).ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("it's not a PEM file")
+	} else if block.Type != blockType {
+		return nil, fmt.Errorf("it contains a %s, not a %s", block.Type, blockType)
+	}
+	return block.Bytes, nil
+}
+
+// signedFiles returns the paths of the files of the library in libDir that are signed: the archives of all the targets,
+// the generated header, the public headers, library.properties, the result.json, the SBOM in sbomFormat (if any)
+// and the .ino of the sketch next to the library
+func signedFiles(libDir *paths.Path, targets []*Target, publicHeaders []string, sbomFormat SBOMFormat) paths.PathList {
+	var files paths.PathList
+	for _, target := range targets {
+		files.Add(libDir.Join("src", target.PrecompiledFolder, libDir.Base()+".a"))
+	}
+	files.Add(libDir.Join("src", libDir.Base()+".h"))
+	for _, header := range publicHeaders {
+		files.Add(libDir.Join("src", header))
+	}
+	files.Add(libDir.Join("library.properties"))
+	files.Add(libDir.Join("extras", "result.json"))
+	if sbomFormat != SBOMNone {
+		files.Add(sbomPath(libDir.Join("extras"), sbomFormat))
+	}
+	sketchName := strings.TrimPrefix(libDir.Base(), "lib")
+	files.Add(libDir.Parent().Join(sketchName, sketchName+".ino"))
+	return files
+}
+
+// signaturePath returns the path of the detached signature of the file in path
+func signaturePath(path *paths.Path) *paths.Path {
+	return path.Parent().Join(path.Base() + signatureSuffix)
+}
+
+// signFiles writes the detached signature of every file, it contains the 64 bytes of the ed25519 signature of the file content.
+// The signature can also be checked with `openssl pkeyutl -verify -rawin`
+func signFiles(files paths.PathList, key ed25519.PrivateKey) error {
+	for _, file := range files {
+		content, err := file.ReadFile()
+		if err != nil {
+			return err
+		}
+		sigPath := signaturePath(file)
+		if err := sigPath.WriteFile(ed25519.Sign(key, content)); err != nil {
+			return err
+		}
+		logrus.Infof("created %s", sigPath.String())
+	}
+	return nil
+}
+
+// VerifySignatures checks the detached signatures of the precompiled library in distDir, the directory created by Precompile,
+// using publicKey: the archives of every target recorded in result.json, the headers, library.properties, the result.json itself
+// and the .ino of the sketch must be signed. Every other file found in the library must be signed too, since it could change
+// how the sketch is compiled (e.g. a source file in the src folder).
+// An error is returned only if distDir is not valid: the missing or invalid signatures are returned in the SignatureReport of every file.
+func VerifySignatures(distDir string, publicKey ed25519.PublicKey) ([]*SignatureReport, error) {
+	libDir, _, resultJson, err := readDist(paths.New(distDir))
+	if err != nil {
+		return nil, &DistError{Path: distDir, Err: err}
+	}
+
+	files := signedFiles(libDir, resultJson.Targets, resultJson.PublicHeaders, SBOMNone)
+	libFiles, err := libDir.ReadDirRecursive()
+	if err != nil {
+		return nil, &DistError{Path: distDir, Err: err}
+	}
+	libFiles.FilterOutDirs()
+	libFiles.FilterOutSuffix(signatureSuffix)
+	libFiles.Sort()
+	for _, file := range libFiles {
+		if !files.Contains(file) {
+			files.Add(file)
+		}
+	}
+
+	var reports []*SignatureReport
+	for _, file := range files {
+		report := &SignatureReport{Path: file.String()}
+		reports = append(reports, report)
+		content, err := file.ReadFile()
+		if err != nil {
+			report.Problem = "cannot read the file: " + err.Error()
+			continue
+		}
+		signature, err := signaturePath(file).ReadFile()
+		if err != nil {
+			report.Problem = "cannot read the signature: " + err.Error()
+		} else if !ed25519.Verify(publicKey, content, signature) {
+			report.Problem = "the signature is not valid"
+		}
+	}
+	return reports, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+func TestSignatures(t *testing.T) {
+	distDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer distDir.RemoveAll()
+	libDir := distDir.Join("libsketch")
+	for name, content := range map[string]string{
+		"libsketch/extras/result.json":                           `{"targets":[{"fqbn":"arduino:samd:mkr1000","precompiledFolder":"cortex-m0plus"},{"fqbn":"arduino:mbed_nano:nano33ble","precompiledFolder":"cortex-m4/fpv4-sp-d16-softfp"}],"publicHeaders":["src/api.h"]}`,
+		"libsketch/src/cortex-m0plus/libsketch.a":                "!<arch>\nsamd",
+		"libsketch/src/cortex-m4/fpv4-sp-d16-softfp/libsketch.a": "!<arch>\nmbed",
+		"libsketch/src/libsketch.h":                              "#include \"src/api.h\"\n",
+		"libsketch/src/src/api.h":                                "void configure();\n",
+		"libsketch/library.properties":                           "name=sketch\nprecompiled=true\n",
+		"sketch/sketch.ino":                                      "#include \"libsketch.h\"\n",
+	} {
+		path := distDir.Join(name)
+		if err := path.Parent().MkdirAll(); err != nil {
+			t.Fatal(err)
+		}
+		if err := path.WriteFile([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the keys are read from PEM files, like the ones created by openssl
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDer, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	publicDer, _ := x509.MarshalPKIXPublicKey(publicKey)
+	privateKeyPath, publicKeyPath := distDir.Join("key.pem"), distDir.Join("key.pub.pem")
+	privateKeyPath.WriteFile(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer}))
+	publicKeyPath.WriteFile(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))
+	if loadedKey, err := LoadPrivateKey(privateKeyPath.String()); err != nil || !loadedKey.Equal(privateKey) {
+		t.Fatalf("cannot load the private key: %v", err)
+	}
+	if loadedKey, err := LoadPublicKey(publicKeyPath.String()); err != nil || !loadedKey.Equal(publicKey) {
+		t.Fatalf("cannot load the public key: %v", err)
+	}
+	if _, err := LoadPublicKey(privateKeyPath.String()); err == nil {
+		t.Errorf("the private key has been loaded as a public key")
+	}
+
+	// verify returns a report for every file, in the same order
+	verify := func(key ed25519.PublicKey, expected ...string) {
+		t.Helper()
+		reports, err := VerifySignatures(distDir.String(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != len(expected) {
+			t.Fatalf("got %d reports, expected %d", len(reports), len(expected))
+		}
+		for i, report := range reports {
+			if report.Problem != expected[i] {
+				t.Errorf("%s: got %q, expected %q", report.Path, report.Problem, expected[i])
+			}
+		}
+	}
+
+	files := signedFiles(libDir, []*Target{{PrecompiledFolder: "cortex-m0plus"}, {PrecompiledFolder: "cortex-m4/fpv4-sp-d16-softfp"}}, []string{"src/api.h"}, SBOMNone)
+	if len(files) != 7 {
+		t.Fatalf("got %d signed files, expected the archives, the headers, library.properties, result.json and the sketch", len(files))
+	}
+	if err := signFiles(files, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	verify(publicKey, "", "", "", "", "", "", "")
+
+	otherPublicKey, _, _ := ed25519.GenerateKey(nil)
+	invalid := "the signature is not valid"
+	verify(otherPublicKey, invalid, invalid, invalid, invalid, invalid, invalid, invalid)
+
+	// a tampered archive, a tampered public header, a tampered library.properties and a missing signature
+	for i, content := range map[int]string{
+		1: "!<arch>\ntampered",
+		3: "void configure();\nvoid backdoor();\n",
+		4: "name=sketch\nprecompiled=true\nldflags=-lbackdoor\n",
+	} {
+		if err := files[i].WriteFile([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := signaturePath(files[5]).Remove(); err != nil {
+		t.Fatal(err)
+	}
+	missing := func(file *paths.Path) string {
+		_, err := signaturePath(file).ReadFile()
+		return "cannot read the signature: " + err.Error()
+	}
+	verify(publicKey, "", invalid, "", invalid, invalid, missing(files[5]), "")
+
+	// the files not listed in result.json could change how the sketch is compiled, they must be signed too
+	extraFiles := paths.PathList{
+		libDir.Join("src", "backdoor.cpp"),
+		libDir.Join("src", "cortex-m4", "libsketch.a"),
+		libDir.Join("src", "extra.h"),
+	}
+	for _, path := range extraFiles {
+		if err := path.WriteFile([]byte("extra")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify(publicKey, "", invalid, "", invalid, invalid, missing(files[5]), "",
+		missing(extraFiles[0]), missing(extraFiles[1]), missing(extraFiles[2]))
+}
@@ -0,0 +1,232 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// mainCppFileName is the name of the file, added to the staged sketch, that calls _setup() and _loop()
+const mainCppFileName = "arduino-cslt-main.cpp"
+
+// mainCppContent is the content of mainCppFileName, older versions of the tool generated a main.cpp
+// with the same content directly in the user's sketch directory
+const mainCppContent = `#include "Arduino.h"
+void _setup();
+void _loop();
+
+void setup() {
+_setup();
+}
+
+void loop() {
+_loop();
+}`
+
+// getInoSketchPath function will take argSketchPath as argument.
+// and will return the path to the ino sketch
+// it will run some checks along the way,
+// we need the main ino file because we need to replace setup() and loop() functions in it
+func getInoSketchPath(argSketchPath string) (inoPath *paths.Path, err error) {
+	sketchPath := paths.New(argSketchPath)
+	if !sketchPath.Exist() {
+		return nil, &SketchError{Path: argSketchPath, Err: fmt.Errorf("the path do not exist")}
+	}
+	if sketchPath.Ext() == ".ino" {
+		inoPath = sketchPath
+	} else { // if there are multiple .ino files in the sketchPath we need to know which is the one containing setup() and loop() functions
+		files, _ := sketchPath.ReadDir()
+		files.FilterSuffix(".ino")
+		if len(files) == 0 {
+			return nil, &SketchError{Path: argSketchPath, Err: fmt.Errorf("the sketch path specified does not contain an .ino file")}
+		} else if len(files) > 1 {
+			return nil, &SketchError{Path: argSketchPath, Err: fmt.Errorf("the sketch path specified contains multiple .ino files:\n%s\nIn order to make the magic please use the path of the .ino file containing the setup() and loop() functions", strings.Join(files.AsStrings(), "\n"))}
+		}
+		inoPath = files[0]
+	}
+	logrus.Infof("the ino file path is %s", inoPath.String())
+	return inoPath, nil
+}
+
+// createStagingDir creates the directory where the sketch is staged and compiled, and adds it to the temporary paths of tx.
+// The directory has a random name, unless deterministic is true: the paths of the sources end up in the object files (e.g. in the debug informations),
+// so in that case the directory is always the same for sketchName. It must not exist, it could be used by another run
+func createStagingDir(tx *transaction, sketchName string, deterministic bool) (*paths.Path, error) {
+	if !deterministic {
+		stagingDir, err := paths.MkTempDir("", "arduino-cslt-")
+		if err != nil {
+			return nil, err
+		}
+		return stagingDir, tx.addTemporary(stagingDir)
+	}
+	stagingDir := paths.TempDir().Join("arduino-cslt-deterministic-" + sketchName)
+	// Mkdir fails if the directory exists, this way the one of another run is never added to tx and removed
+	if err := os.Mkdir(stagingDir.String(), 0700); os.IsExist(err) {
+		return nil, fmt.Errorf("%s already exists: another deterministic run on the same sketch could be in progress, otherwise use the repair command or remove it", stagingDir.String())
+	} else if err != nil {
+		return nil, err
+	}
+	return stagingDir, tx.addTemporary(stagingDir)
+}
+
+// stageSketch function will copy the sketch directory containing inoPath in the stagingDir.
+// The copy is placed in a subdirectory named after the .ino file, as required by the sketch specification,
+// and it's the one patched and compiled: this way the user's sketch directory is never written to, and it can be read-only too.
+// Hidden files and directories (e.g. .git) are not copied because they are ignored by the builder anyway.
+// It returns the path of the .ino file inside the staging directory
+func stageSketch(inoPath, stagingDir *paths.Path) (stagedInoPath *paths.Path, err error) {
+	sketchName := strings.TrimSuffix(inoPath.Base(), inoPath.Ext())
+	stagedSketchDir := stagingDir.Join(sketchName)
+	if err := copySketchDir(inoPath.Parent(), stagedSketchDir); err != nil {
+		return nil, fmt.Errorf("cannot copy the sketch in %s: %s", stagingDir.String(), err)
+	}
+	stagedInoPath = stagedSketchDir.Join(sketchName + ".ino")
+	logrus.Infof("staged %s in %s", inoPath.Parent().String(), stagedSketchDir.String())
+	return stagedInoPath, nil
+}
+
+// copySketchDir is an helper function that recursively copies srcDir into dstDir skipping hidden files.
+// The permissions of the original files are not preserved: the copies are always writable,
+// because the sketch could come from a read-only checkout and we need to patch it
+func copySketchDir(srcDir, dstDir *paths.Path) error {
+	if err := os.Mkdir(dstDir.String(), 0755); err != nil {
+		return err
+	}
+	files, err := srcDir.ReadDir()
+	if err != nil {
+		return err
+	}
+	files.FilterOutHiddenFiles()
+	for _, file := range files {
+		dstFile := dstDir.Join(file.Base())
+		if file.IsDir() {
+			if err := copySketchDir(file, dstFile); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := file.CopyTo(dstFile); err != nil {
+			return err
+		}
+		if err := os.Chmod(dstFile.String(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createMainCpp function will create the mainCppFileName file inside the sketch directory of inoPath
+// we do this because setup() and loop() functions will be replaced inside the ino file, in order to allow the linking afterwards
+// creating this file is mandatory, we include also Arduino.h because it's a step done by the builder during the building phase, but only for ino files
+// the file is not named main.cpp to avoid overwriting a main.cpp which is part of the user's sketch
+func createMainCpp(inoPath *paths.Path) error {
+	mainCppPath := inoPath.Parent().Join(mainCppFileName)
+	if mainCppPath.Exist() {
+		return &SketchError{Path: inoPath.Parent().String(), Err: fmt.Errorf("the sketch already contains a %s file, please rename it", mainCppFileName)}
+	}
+	return createFile(mainCppPath, mainCppContent)
+}
+
+// patchSketch function will modify the content of the inoPath sketch passed as argument,
+// the definitions of setup() and loop() are renamed to _setup() and _loop(),
+// we do this to allow the compile process to succeed
+func patchSketch(inoPath *paths.Path) error {
+	oldSketchContent, err := os.ReadFile(inoPath.String())
+	if err != nil {
+		return err
+	}
+	newSketchContent, err := renameSketchFunctions(oldSketchContent, map[string]string{"setup": "_setup", "loop": "_loop"})
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(inoPath.String(), newSketchContent, 0644); err != nil {
+		return err
+	}
+	logrus.Infof("replaced setup() and loop() functions in %s", inoPath.String())
+	return nil
+}
+
+// headerFileSuffixes are the extensions of the header files that can be exported by the library
+var headerFileSuffixes = []string{".h", ".hh", ".hpp"}
+
+// findPublicHeaders returns the headers in sketchDir matching the patterns, as slash separated paths relative to sketchDir, sorted.
+// Every pattern must match at least one header, this way a typo doesn't go unnoticed.
+// sketchName is used to check that no header conflicts with the lib{sketchName}.h generated for the library
+func findPublicHeaders(sketchDir *paths.Path, patterns []string, sketchName string) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	files, err := sketchDir.ReadDirRecursive()
+	if err != nil {
+		return nil, err
+	}
+	files.FilterOutDirs()
+	files.FilterSuffix(headerFileSuffixes...)
+
+	var headers []string
+	for _, pattern := range patterns {
+		matched := false
+		for _, file := range files {
+			relPath, err := file.RelFrom(sketchDir)
+			if err != nil {
+				return nil, err
+			}
+			header := filepath.ToSlash(relPath.String())
+			if ok, err := path.Match(pattern, header); err != nil {
+				return nil, &InvalidOptionsError{Reason: fmt.Sprintf("invalid public header pattern %q: %s", pattern, err)}
+			} else if !ok {
+				continue
+			}
+			if header == "lib"+sketchName+".h" {
+				return nil, &InvalidOptionsError{Reason: fmt.Sprintf("the public header %s conflicts with the one generated for the library", header)}
+			}
+			matched = true
+			headers = appendIfMissing(headers, header)
+		}
+		if !matched {
+			return nil, &InvalidOptionsError{Reason: fmt.Sprintf("the public header pattern %q doesn't match any header of the sketch", pattern)}
+		}
+	}
+	sort.Strings(headers)
+
+	// the headers are copied in the library keeping their path, a sketch header included by them must be copied too
+	sketchFiles := map[string]bool{}
+	for _, file := range files {
+		if relPath, err := file.RelFrom(sketchDir); err == nil {
+			sketchFiles[filepath.ToSlash(relPath.String())] = true
+		}
+	}
+	for _, header := range headers {
+		content, err := sketchDir.Join(header).ReadFile()
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range quotedIncludeRegexp.FindAllStringSubmatch(string(content), -1) {
+			// the quoted includes are looked up in the directory of the header first, then in the src folder of the library
+			for _, included := range []string{path.Join(path.Dir(header), match[1]), path.Clean(match[1])} {
+				if !sketchFiles[included] {
+					continue
+				}
+				if !contains(headers, included) {
+					return nil, &InvalidOptionsError{Reason: fmt.Sprintf("the public header %s includes %s, that is not exported: add it with --public-header", header, included)}
+				}
+				break
+			}
+		}
+	}
+	return headers, nil
+}
+
+// quotedIncludeRegexp matches the #include "file" directives, the included file is the first group
+var quotedIncludeRegexp = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*include[ \t]*"([^"]+)"`)
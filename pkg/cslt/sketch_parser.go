@@ -0,0 +1,427 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tokenKind is the kind of a token found by the sketch tokenizer
+type tokenKind int
+
+const (
+	identToken   tokenKind = iota // identifiers and keywords
+	punctToken                    // single punctuation characters
+	literalToken                  // numbers, strings and character literals
+)
+
+// token is a single C++ token of the sketch, comments and preprocessor directives are not tokens
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int // offset of the token in the source
+	// ppBranch identifies the preprocessor conditional branch (#if, #elif, #else) containing the token,
+	// 0 means the token is not inside a conditional block
+	ppBranch int
+}
+
+// tokenizeSketch function splits the C++ source in tokens.
+// It's not a complete C++ lexer, but it knows enough to skip comments, string and character literals
+// (raw strings too) and preprocessor directives, so that the identifiers found are only the ones in actual code.
+func tokenizeSketch(src []byte) []token {
+	var tokens []token
+	// ppBranches is the stack of the preprocessor conditional branches we are in
+	ppBranches := []int{0}
+	lastPpBranch := 0
+	lineStart := true // we are at the beginning of a line, ignoring whitespaces: a # starts a preprocessor directive
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n':
+			lineStart = true
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case c == '\\' && i+1 < len(src) && (src[i+1] == '\n' || src[i+1] == '\r'): // line continuation
+			i += 2
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			i = skipLineComment(src, i)
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			i = skipBlockComment(src, i)
+		case c == '#' && lineStart:
+			end := skipDirective(src, i)
+			directive := strings.Fields(strings.TrimPrefix(string(src[i:end]), "#"))
+			if len(directive) > 0 {
+				switch directive[0] {
+				case "if", "ifdef", "ifndef":
+					lastPpBranch++
+					ppBranches = append(ppBranches, lastPpBranch)
+				case "elif", "else", "elifdef", "elifndef":
+					if len(ppBranches) > 1 {
+						lastPpBranch++
+						ppBranches[len(ppBranches)-1] = lastPpBranch
+					}
+				case "endif":
+					if len(ppBranches) > 1 {
+						ppBranches = ppBranches[:len(ppBranches)-1]
+					}
+				}
+			}
+			i = end
+		default:
+			lineStart = false
+			start := i
+			kind := punctToken
+			switch {
+			case isIdentStart(c):
+				for i < len(src) && isIdentChar(src[i]) {
+					i++
+				}
+				kind = identToken
+				// identifiers could be the prefix of a string or character literal: u8"", L'', R"()"...
+				if i < len(src) && (src[i] == '"' || src[i] == '\'') && isLiteralPrefix(string(src[start:i])) {
+					i = skipLiteral(src, start, i)
+					kind = literalToken
+				}
+			case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+				i = skipNumber(src, i)
+				kind = literalToken
+			case c == '"' || c == '\'':
+				i = skipLiteral(src, start, i)
+				kind = literalToken
+			default:
+				i++
+			}
+			tokens = append(tokens, token{kind: kind, text: string(src[start:i]), offset: start, ppBranch: ppBranches[len(ppBranches)-1]})
+		}
+	}
+	return tokens
+}
+
+// skipLineComment returns the offset of the end of the // comment starting at i
+func skipLineComment(src []byte, i int) int {
+	for i < len(src) && src[i] != '\n' {
+		if src[i] == '\\' && i+1 < len(src) && src[i+1] == '\n' { // the comment continues on the next line
+			i++
+		}
+		i++
+	}
+	return i
+}
+
+// skipBlockComment returns the offset following the /* */ comment starting at i
+func skipBlockComment(src []byte, i int) int {
+	if end := strings.Index(string(src[i+2:]), "*/"); end != -1 {
+		return i + 2 + end + 2
+	}
+	return len(src)
+}
+
+// skipDirective returns the offset of the end of the preprocessor directive starting at i,
+// taking into account line continuations and comments spanning multiple lines.
+// The text of #warning and #error is free-form, so quotes and apostrophes there don't start literals
+func skipDirective(src []byte, i int) int {
+	name := strings.Fields(strings.TrimPrefix(string(src[i:skipLineComment(src, i)]), "#"))
+	freeText := len(name) > 0 && (name[0] == "warning" || name[0] == "error")
+	for i < len(src) && src[i] != '\n' {
+		switch {
+		case src[i] == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			i += 2
+		case src[i] == '\\' && i+2 < len(src) && src[i+1] == '\r' && src[i+2] == '\n':
+			i += 3
+		case src[i] == '/' && i+1 < len(src) && src[i+1] == '*':
+			i = skipBlockComment(src, i)
+		case src[i] == '/' && i+1 < len(src) && src[i+1] == '/':
+			return skipLineComment(src, i)
+		case (src[i] == '"' || src[i] == '\'') && !freeText:
+			i = skipLiteral(src, i, i)
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// skipNumber returns the offset following the number starting at i, it follows the pp-number definition
+// so it handles exponents, suffixes and digit separators
+func skipNumber(src []byte, i int) int {
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case (c == '+' || c == '-') && (src[i-1] == 'e' || src[i-1] == 'E' || src[i-1] == 'p' || src[i-1] == 'P'):
+			i++
+		case c == '\'' && i+1 < len(src) && isIdentChar(src[i+1]):
+			i += 2
+		case isIdentChar(c) || c == '.':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipLiteral returns the offset following the string or character literal starting at start,
+// quote is the offset of the opening quote, the part between start and quote is the literal prefix
+func skipLiteral(src []byte, start, quote int) int {
+	delim := src[quote]
+	if delim == '"' && strings.HasSuffix(string(src[start:quote]), "R") { // raw string: R"delimiter( ... )delimiter"
+		open := strings.IndexByte(string(src[quote:]), '(')
+		if open == -1 {
+			return len(src)
+		}
+		closing := ")" + string(src[quote+1:quote+open]) + "\""
+		if end := strings.Index(string(src[quote+open:]), closing); end != -1 {
+			return quote + open + end + len(closing)
+		}
+		return len(src)
+	}
+	i := quote + 1
+	for i < len(src) && src[i] != delim && src[i] != '\n' {
+		if src[i] == '\\' {
+			i++
+		}
+		i++
+	}
+	if i >= len(src) {
+		return len(src)
+	}
+	if src[i] == '\n' { // unterminated literal, the newline is not part of it
+		return i
+	}
+	return i + 1
+}
+
+// isLiteralPrefix returns true if prefix is a valid string or character literal encoding prefix
+func isLiteralPrefix(prefix string) bool {
+	switch prefix {
+	case "L", "u", "U", "u8", "R", "LR", "uR", "UR", "u8R":
+		return true
+	}
+	return false
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// findFunctionDefinitions function looks for the definitions of the global function name in tokens,
+// the function must return void and take no parameters, like setup() and loop().
+// It returns the tokens corresponding to the name of the function in every definition found.
+// Declarations are ignored, as well as functions defined inside namespaces, classes or other functions.
+func findFunctionDefinitions(tokens []token, name string) []token {
+	var definitions []token
+	// scopes is the stack of the braces we are in, true means the scope is transparent (e.g. extern "C" { ... }),
+	// so what's inside is still at global scope
+	var scopes []bool
+	parens := 0 // the nesting level of () and [] at the current scope
+	for i, tok := range tokens {
+		if tok.kind != punctToken && tok.kind != identToken {
+			continue
+		}
+		switch tok.text {
+		case "{":
+			transparent := i >= 2 && tokens[i-1].text == `"C"` && tokens[i-2].text == "extern"
+			scopes = append(scopes, transparent)
+			parens = 0
+			continue
+		case "}":
+			if len(scopes) > 0 {
+				scopes = scopes[:len(scopes)-1]
+			}
+			parens = 0
+			continue
+		case "(", "[":
+			parens++
+			continue
+		case ")", "]":
+			parens--
+			continue
+		}
+		if tok.text != name || parens != 0 || !isGlobalScope(scopes) {
+			continue
+		}
+		if isFunctionDefinition(tokens, i) {
+			definitions = append(definitions, tok)
+		}
+	}
+	return definitions
+}
+
+// isGlobalScope returns true if all the scopes are transparent
+func isGlobalScope(scopes []bool) bool {
+	for _, transparent := range scopes {
+		if !transparent {
+			return false
+		}
+	}
+	return true
+}
+
+// isFunctionDefinition returns true if the identifier tokens[nameIdx] is the name of a function definition
+// with a void return type and no parameters, e.g.:
+// void setup() {
+// void setup(void) {
+// [[gnu::cold]] void __attribute__((noinline)) setup () noexcept {
+func isFunctionDefinition(tokens []token, nameIdx int) bool {
+	if !hasVoidReturnType(tokens, nameIdx) {
+		return false
+	}
+
+	// the parameters list must be empty or contain only void
+	i := nameIdx + 1
+	if i >= len(tokens) || tokens[i].text != "(" {
+		return false
+	}
+	i++
+	if i < len(tokens) && tokens[i].text == "void" {
+		i++
+	}
+	if i >= len(tokens) || tokens[i].text != ")" {
+		return false
+	}
+	i++
+
+	// the body could be preceded by some qualifiers and attributes, e.g. noexcept or __attribute__((...))
+	for i < len(tokens) {
+		switch {
+		case tokens[i].text == "{":
+			return true
+		case tokens[i].text == "(":
+			i = skipForward(tokens, i, "(", ")") + 1
+		case tokens[i].text == "[":
+			i = skipForward(tokens, i, "[", "]") + 1
+		case tokens[i].kind == identToken:
+			i++
+		default: // it's a declaration (;) or something else
+			return false
+		}
+	}
+	return false
+}
+
+// hasVoidReturnType returns true if the token preceding the function name tokens[nameIdx],
+// skipping the attributes, is void. This way qualified names (e.g. Foo::setup)
+// and more complex declarators (e.g. pointers to function) are excluded
+func hasVoidReturnType(tokens []token, nameIdx int) bool {
+	i := nameIdx - 1
+	for i >= 0 {
+		switch {
+		case tokens[i].text == "]" && i > 0 && tokens[i-1].text == "]": // [[attribute]]
+			i = skipBackwards(tokens, i, "[", "]") - 1
+		case tokens[i].text == ")": // __attribute__((attribute))
+			i = skipBackwards(tokens, i, "(", ")") - 1
+			if i < 0 || tokens[i].text != "__attribute__" {
+				return false
+			}
+			i--
+		default:
+			return tokens[i].text == "void"
+		}
+	}
+	return false
+}
+
+// skipBackwards returns the index of the open token matching the close token at tokens[i]
+func skipBackwards(tokens []token, i int, open, close string) int {
+	depth := 0
+	for ; i >= 0; i-- {
+		switch tokens[i].text {
+		case close:
+			depth++
+		case open:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// skipForward returns the index of the close token matching the open token at tokens[i]
+func skipForward(tokens []token, i int, open, close string) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// renameSketchFunctions function renames the definitions of the functions in src following the renames map (old name -> new name).
+// Every function must be defined exactly once, unless the definitions are in different
+// preprocessor conditional branches (e.g. #ifdef ... #else ...), in that case all of them are renamed.
+// An error is returned if a definition cannot be found, if there are multiple definitions
+// or if the new name is already used in the sketch.
+func renameSketchFunctions(src []byte, renames map[string]string) ([]byte, error) {
+	tokens := tokenizeSketch(src)
+	var names []string
+	for name := range renames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var toRename []token
+	for _, name := range names {
+		for _, tok := range tokens {
+			if tok.kind == identToken && tok.text == renames[name] {
+				return nil, fmt.Errorf("the sketch already uses %s (line %d), cannot rename %s() to %s()", renames[name], lineOf(src, tok.offset), name, renames[name])
+			}
+		}
+		definitions := findFunctionDefinitions(tokens, name)
+		if len(definitions) == 0 {
+			return nil, fmt.Errorf("cannot find the definition of void %s()", name)
+		}
+		if len(definitions) > 1 && !inDistinctPpBranches(definitions) {
+			var lines []string
+			for _, definition := range definitions {
+				lines = append(lines, fmt.Sprint(lineOf(src, definition.offset)))
+			}
+			return nil, fmt.Errorf("found %d definitions of void %s() at lines %s", len(definitions), name, strings.Join(lines, ", "))
+		}
+		toRename = append(toRename, definitions...)
+	}
+
+	// let's do the replacements in reverse order, this way the offsets are still valid
+	sort.Slice(toRename, func(i, j int) bool { return toRename[i].offset > toRename[j].offset })
+	res := append([]byte{}, src...)
+	for _, tok := range toRename {
+		renamed := append([]byte(renames[tok.text]), res[tok.offset+len(tok.text):]...)
+		res = append(res[:tok.offset], renamed...)
+	}
+	return res, nil
+}
+
+// inDistinctPpBranches returns true if every token is inside a different preprocessor conditional branch
+func inDistinctPpBranches(tokens []token) bool {
+	branches := map[int]bool{}
+	for _, tok := range tokens {
+		if tok.ppBranch == 0 || branches[tok.ppBranch] {
+			return false
+		}
+		branches[tok.ppBranch] = true
+	}
+	return true
+}
+
+// lineOf returns the line number (starting from 1) of offset in src
+func lineOf(src []byte, offset int) int {
+	return strings.Count(string(src[:offset]), "\n") + 1
+}
@@ -0,0 +1,134 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenameSketchFunctions(t *testing.T) {
+	renames := map[string]string{"setup": "_setup", "loop": "_loop"}
+	for _, test := range []struct {
+		name     string
+		src      string
+		expected string
+		err      string
+	}{
+		{
+			name:     "simple",
+			src:      "void setup() {}\nvoid loop() {}\n",
+			expected: "void _setup() {}\nvoid _loop() {}\n",
+		},
+		{
+			name:     "void parameter",
+			src:      "void setup(void) {}\nvoid loop( void ) {}\n",
+			expected: "void _setup(void) {}\nvoid _loop( void ) {}\n",
+		},
+		{
+			name:     "spacing",
+			src:      "void   setup\t( )\t{}\nvoid loop(){}\n",
+			expected: "void   _setup\t( )\t{}\nvoid _loop(){}\n",
+		},
+		{
+			name:     "multi-line",
+			src:      "void\nsetup\n(\n)\n{\n}\nvoid loop()\n{\n}\n",
+			expected: "void\n_setup\n(\n)\n{\n}\nvoid _loop()\n{\n}\n",
+		},
+		{
+			name:     "attributes",
+			src:      "[[gnu::cold]] void __attribute__((noinline)) setup() noexcept {}\nvoid loop() __attribute__((hot)) {}\n",
+			expected: "[[gnu::cold]] void __attribute__((noinline)) _setup() noexcept {}\nvoid _loop() __attribute__((hot)) {}\n",
+		},
+		{
+			name:     "declarations are ignored",
+			src:      "void setup();\nvoid loop(void);\nvoid setup() {}\nvoid loop() { setup(); }\n",
+			expected: "void setup();\nvoid loop(void);\nvoid _setup() {}\nvoid _loop() { setup(); }\n",
+		},
+		{
+			name: "comments and strings",
+			src: "// void setup() {}\n/* void loop() {} */\nconst char *s = \"void setup() {}\";\nconst char *r = R\"(void loop() {})\";\n" +
+				"void setup() { Serial.println(\"void loop() {\"); }\nvoid loop() {}\n",
+			expected: "// void setup() {}\n/* void loop() {} */\nconst char *s = \"void setup() {}\";\nconst char *r = R\"(void loop() {})\";\n" +
+				"void _setup() { Serial.println(\"void loop() {\"); }\nvoid _loop() {}\n",
+		},
+		{
+			name:     "extern C",
+			src:      "extern \"C\" {\nvoid setup() {}\n}\nvoid loop() {}\n",
+			expected: "extern \"C\" {\nvoid _setup() {}\n}\nvoid _loop() {}\n",
+		},
+		{
+			name:     "nested scopes are ignored",
+			src:      "namespace ns { void setup() {} }\nstruct S { void loop() {} };\nvoid S::setup() {}\nvoid setup() {}\nvoid loop() {}\n",
+			expected: "namespace ns { void setup() {} }\nstruct S { void loop() {} };\nvoid S::setup() {}\nvoid _setup() {}\nvoid _loop() {}\n",
+		},
+		{
+			name:     "preprocessor branches",
+			src:      "#ifdef FOO\nvoid setup() {}\n#else\nvoid setup() {}\n#endif\nvoid loop() {}\n",
+			expected: "#ifdef FOO\nvoid _setup() {}\n#else\nvoid _setup() {}\n#endif\nvoid _loop() {}\n",
+		},
+		{
+			name:     "unterminated string at end of file",
+			src:      "void setup() {}\nvoid loop() {}\nconst char *s = \"abc",
+			expected: "void _setup() {}\nvoid _loop() {}\nconst char *s = \"abc",
+		},
+		{
+			name:     "unterminated char at end of file",
+			src:      "void setup() {}\nvoid loop() {}\nchar c = '\\",
+			expected: "void _setup() {}\nvoid _loop() {}\nchar c = '\\",
+		},
+		{
+			name:     "unterminated literal stops at the newline",
+			src:      "char c = ';\nvoid setup() {}\nvoid loop() {}\n",
+			expected: "char c = ';\nvoid _setup() {}\nvoid _loop() {}\n",
+		},
+		{
+			name:     "unterminated include at end of file",
+			src:      "void setup() {}\nvoid loop() {}\n#include \"x",
+			expected: "void _setup() {}\nvoid _loop() {}\n#include \"x",
+		},
+		{
+			name:     "apostrophe in a directive",
+			src:      "#warning don't do this\nvoid setup(){}\n#error it's not\nvoid loop(){}\n",
+			expected: "#warning don't do this\nvoid _setup(){}\n#error it's not\nvoid _loop(){}\n",
+		},
+		{
+			name: "no definition",
+			src:  "void setup();\nvoid loop() {}\n",
+			err:  "cannot find the definition of void setup()",
+		},
+		{
+			name: "parameters",
+			src:  "void setup(int x) {}\nvoid loop() {}\n",
+			err:  "cannot find the definition of void setup()",
+		},
+		{
+			name: "several definitions",
+			src:  "void setup() {}\nvoid loop() {}\nvoid loop() {}\n",
+			err:  "found 2 definitions of void loop() at lines 2, 3",
+		},
+		{
+			name: "new name already used",
+			src:  "void setup() {}\nvoid loop() {}\nint _loop;\n",
+			err:  "the sketch already uses _loop (line 3)",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := renameSketchFunctions([]byte(test.src), renames)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(res) != test.expected {
+				t.Errorf("got:\n%s\nexpected:\n%s", res, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+func TestFindPublicHeaders(t *testing.T) {
+	sketchDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sketchDir.RemoveAll()
+	for name, content := range map[string]string{
+		"sketch.ino":          "#include \"api.h\"\nvoid setup() {}\nvoid loop() {}\n",
+		"api.h":               "#include <Arduino.h>\n#include \"src/api/types.h\"\nvoid configure();\n",
+		"config.h":            "#include \"internal.h\"\n",
+		"internal.h":          "#define INTERNAL 1\n",
+		"libsketch.h":         "",
+		"src/api/types.h":     "#include \"units.hpp\"\n  #  include \"Wire.h\"\n",
+		"src/api/units.hpp":   "typedef int meters;\n",
+		"src/api/private.cpp": "#include \"types.h\"\n",
+	} {
+		path := sketchDir.Join(name)
+		if err := path.Parent().MkdirAll(); err != nil {
+			t.Fatal(err)
+		}
+		if err := path.WriteFile([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		patterns []string
+		expected []string
+		err      string
+	}{
+		{"none", nil, nil, ""},
+		{"single", []string{"internal.h"}, []string{"internal.h"}, ""},
+		{"pattern", []string{"src/api/*"}, []string{"src/api/types.h", "src/api/units.hpp"}, ""},
+		{"sorted without duplicates", []string{"src/api/*", "api.h", "src/api/types.h"}, []string{"api.h", "src/api/types.h", "src/api/units.hpp"}, ""},
+		{"no match", []string{"missing.h"}, nil, `the public header pattern "missing.h" doesn't match any header of the sketch`},
+		{"not a header", []string{"src/api/private.cpp"}, nil, "doesn't match any header"},
+		{"invalid pattern", []string{"[.h"}, nil, `invalid public header pattern "[.h"`},
+		{"conflict", []string{"libsketch.h"}, nil, "the public header libsketch.h conflicts with the one generated for the library"},
+		{"include not exported", []string{"config.h"}, nil, "the public header config.h includes internal.h, that is not exported"},
+		{"include relative to the header", []string{"src/api/types.h"}, nil, "the public header src/api/types.h includes src/api/units.hpp, that is not exported"},
+		{"include relative to the library", []string{"api.h", "src/api/units.hpp"}, nil, "the public header api.h includes src/api/types.h, that is not exported"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			headers, err := findPublicHeaders(sketchDir, test.patterns, "sketch")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(headers, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("headers are %v, expected %v", headers, test.expected)
+			}
+		})
+	}
+}
+
+func TestStageSketch(t *testing.T) {
+	tmpDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpDir.RemoveAll()
+	// the journals are written in the user cache dir
+	t.Setenv("XDG_CACHE_HOME", tmpDir.Join("cache").String())
+	t.Setenv("HOME", tmpDir.String())
+
+	// the sketch has its own main.cpp, older versions of the tool overwrote it and then removed it
+	sketchDir := tmpDir.Join("sketch")
+	sketchFiles := map[string]string{
+		"sketch.ino":     "#include \"helper.h\"\nvoid setup() { help(); }\nvoid loop() {}\n",
+		"main.cpp":       "#include \"helper.h\"\nvoid help() {}\n",
+		"helper.h":       "void help();\n",
+		"src/util.cpp":   "int util() { return 1; }\n",
+		".git/HEAD":      "ref: refs/heads/main\n",
+		".hidden_notes":  "not staged",
+		"data/blob.bin":  "\x00\x01\x02",
+		"src/sub/a.ino":  "// not the main file\n",
+		"sketch.ino.bak": "void setup() {}\n",
+	}
+	for name, content := range sketchFiles {
+		path := sketchDir.Join(name)
+		if err := path.Parent().MkdirAll(); err != nil {
+			t.Fatal(err)
+		}
+		if err := path.WriteFile([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inoPath := sketchDir.Join("sketch.ino")
+
+	tx, err := beginTransaction(inoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagingDir, err := createStagingDir(tx, "sketch", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagedInoPath, err := stageSketch(inoPath, stagingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createMainCpp(stagedInoPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := patchSketch(stagedInoPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// the staged copy is patched, the user's main.cpp is kept next to the generated one and hidden files are not copied
+	stagedDir := stagedInoPath.Parent()
+	for name, expected := range map[string]string{
+		"sketch.ino":    "#include \"helper.h\"\nvoid _setup() { help(); }\nvoid _loop() {}\n",
+		"main.cpp":      sketchFiles["main.cpp"],
+		mainCppFileName: mainCppContent,
+		"src/util.cpp":  sketchFiles["src/util.cpp"],
+	} {
+		if content, err := stagedDir.Join(name).ReadFile(); err != nil || string(content) != expected {
+			t.Errorf("staged %s: got %q (%v), expected %q", name, content, err, expected)
+		}
+	}
+	for _, name := range []string{".git", ".hidden_notes"} {
+		if stagedDir.Join(name).Exist() {
+			t.Errorf("the hidden file %s has been staged", name)
+		}
+	}
+
+	if err := tx.end(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if stagingDir.Exist() {
+		t.Errorf("the staging directory %s has not been removed", stagingDir)
+	}
+
+	// the sketch directory is the same, byte for byte, and it doesn't contain any other file
+	files, err := sketchDir.ReadDirRecursive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files.FilterOutDirs()
+	if len(files) != len(sketchFiles) {
+		t.Errorf("the sketch directory contains %d files, expected %d: %s", len(files), len(sketchFiles), files)
+	}
+	for name, expected := range sketchFiles {
+		if content, err := sketchDir.Join(name).ReadFile(); err != nil || string(content) != expected {
+			t.Errorf("%s: got %q (%v), expected %q", name, content, err, expected)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// journal contains what's needed to recover from an interrupted run,
+// it's written on disk before the sketch is staged and it's kept up to date during the whole run
+type journal struct {
+	Pid       int       `json:"pid"`
+	StartedAt time.Time `json:"startedAt"`
+	// InoPath is the path of the main .ino file of the sketch being compiled
+	InoPath string `json:"inoPath"`
+	// InoContent is the backup of the original content of the .ino file
+	InoContent []byte `json:"inoContent"`
+	// Temporary contains the paths removed when the transaction ends, whatever the outcome
+	Temporary []string `json:"temporary"`
+	// Created contains the paths removed only if the transaction is rolled back
+	Created []string `json:"created"`
+	// Replaced contains the paths moved aside before being overwritten, they are moved back if the transaction is rolled back
+	Replaced []*replacedPath `json:"replaced"`
+	// Committed is set before the cleanup of a successful run, the created paths are the new output
+	// and the backups of the replaced paths could be already removed: nothing must be rolled back
+	Committed bool `json:"committed"`
+}
+
+// replacedPath is a path moved aside in BackupPath
+type replacedPath struct {
+	Path       string `json:"path"`
+	BackupPath string `json:"backupPath"`
+}
+
+// transaction tracks the files and directories created during a run,
+// so that they can be removed if the run fails or it's interrupted by a termination signal
+type transaction struct {
+	journal     *journal
+	journalPath *paths.Path
+}
+
+// journalDir returns the directory containing the journals of the runs in progress (or interrupted)
+func journalDir() (*paths.Path, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return paths.New(cacheDir, "arduino-cslt", "journal"), nil
+}
+
+// beginTransaction function starts a new transaction for the sketch whose main file is inoPath,
+// the journal containing the backup of inoPath is written before returning
+func beginTransaction(inoPath *paths.Path) (*transaction, error) {
+	absInoPath, err := inoPath.Abs()
+	if err != nil {
+		return nil, err
+	}
+	inoContent, err := absInoPath.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := dir.MkdirAll(); err != nil {
+		return nil, err
+	}
+	journalFile, err := paths.MkTempFile(dir, "journal-")
+	if err != nil {
+		return nil, err
+	}
+	journalFile.Close()
+
+	tx := &transaction{
+		journal: &journal{
+			Pid:        os.Getpid(),
+			StartedAt:  time.Now(),
+			InoPath:    absInoPath.String(),
+			InoContent: inoContent,
+		},
+		journalPath: paths.New(journalFile.Name()),
+	}
+	if err := tx.writeJournal(); err != nil {
+		tx.journalPath.Remove()
+		return nil, err
+	}
+	logrus.Debugf("created journal %s", tx.journalPath.String())
+	return tx, nil
+}
+
+// addTemporary adds path to the paths to remove when the transaction ends
+func (tx *transaction) addTemporary(path *paths.Path) error {
+	tx.journal.Temporary = append(tx.journal.Temporary, path.String())
+	return tx.writeJournal()
+}
+
+// addCreated adds path to the paths to remove if the transaction is rolled back,
+// it must be called before path is created
+func (tx *transaction) addCreated(path *paths.Path) error {
+	tx.journal.Created = append(tx.journal.Created, path.String())
+	return tx.writeJournal()
+}
+
+// moveAside moves path inside backupDir, this way it can be overwritten and restored if the transaction is rolled back.
+// backupDir must be on the same filesystem of path, and it should be removed when the transaction ends
+func (tx *transaction) moveAside(path, backupDir *paths.Path) error {
+	backupPath := backupDir.Join(fmt.Sprintf("%d-%s", len(tx.journal.Replaced), path.Base()))
+	// the journal is written first, if the run is killed before the rename there is nothing to restore
+	tx.journal.Replaced = append(tx.journal.Replaced, &replacedPath{Path: path.String(), BackupPath: backupPath.String()})
+	if err := tx.writeJournal(); err != nil {
+		return err
+	}
+	if err := path.Rename(backupPath); err != nil {
+		return err
+	}
+	logrus.Infof("moved %s to %s", path.String(), backupPath.String())
+	return nil
+}
+
+// writeJournal saves the journal on disk, the file is replaced atomically so it's always readable
+func (tx *transaction) writeJournal() error {
+	journalContent, err := json.MarshalIndent(tx.journal, "", " ")
+	if err != nil {
+		return err
+	}
+	tmpPath := paths.New(tx.journalPath.String() + ".tmp")
+	if err := tmpPath.WriteFile(journalContent); err != nil {
+		return err
+	}
+	return tmpPath.Rename(tx.journalPath)
+}
+
+// end function ends the transaction: if err is not nil or ctx has been canceled the transaction is rolled back,
+// otherwise it's committed, marking the journal as such before cleaning up. The journal is removed only if the transaction ended cleanly.
+// It returns the error to report to the user
+func (tx *transaction) end(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		// the error returned by the interrupted operation (e.g. "signal: killed") is not meaningful
+		err = &InterruptedError{Err: ctx.Err()}
+	}
+	if err == nil {
+		// the journal is marked as committed before removing the backups, this way an interrupted cleanup
+		// is never rolled back by a repair, that would remove the new output without restoring the old one
+		tx.journal.Committed = true
+		if commitErr := tx.writeJournal(); commitErr != nil {
+			tx.journal.Committed = false
+			err = fmt.Errorf("cannot commit (journal %s): %s", tx.journalPath.String(), commitErr)
+		}
+	}
+	if err != nil {
+		logrus.Warnf("rolling back: %s", err)
+		if rollbackErr := removeAll(tx.journal.Created); rollbackErr != nil {
+			return fmt.Errorf("%s, and rollback failed (journal %s): %s", err, tx.journalPath.String(), rollbackErr)
+		}
+		if rollbackErr := restoreAll(tx.journal.Replaced); rollbackErr != nil {
+			return fmt.Errorf("%s, and rollback failed (journal %s): %s", err, tx.journalPath.String(), rollbackErr)
+		}
+	}
+	if cleanupErr := removeAll(tx.journal.Temporary); cleanupErr != nil {
+		logrus.Warnf("cannot clean up (journal %s): %s", tx.journalPath.String(), cleanupErr)
+		return err
+	}
+	if removeErr := tx.journalPath.Remove(); removeErr != nil {
+		logrus.Warn(removeErr)
+	}
+	return err
+}
+
+// removeAll removes all the paths, in reverse order, and returns the first error encountered
+func removeAll(pathsToRemove []string) error {
+	var firstErr error
+	for i := len(pathsToRemove) - 1; i >= 0; i-- {
+		path := paths.New(pathsToRemove[i])
+		if err := path.RemoveAll(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logrus.Infof("removed %s", path.String())
+	}
+	return firstErr
+}
+
+// restoreAll moves back the replaced paths, in reverse order, removing what has been written in their place.
+// The paths never moved aside are skipped. It returns the first error encountered
+func restoreAll(replaced []*replacedPath) error {
+	var firstErr error
+	for i := len(replaced) - 1; i >= 0; i-- {
+		path := paths.New(replaced[i].Path)
+		backupPath := paths.New(replaced[i].BackupPath)
+		if backupPath.NotExist() {
+			continue
+		}
+		err := path.RemoveAll()
+		if err == nil {
+			err = backupPath.Rename(path)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logrus.Infof("restored %s", path.String())
+	}
+	return firstErr
+}
@@ -0,0 +1,102 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	tmpDir, err := paths.MkTempDir("", "arduino-cslt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpDir.RemoveAll()
+	// the journals are written in the user cache dir
+	t.Setenv("XDG_CACHE_HOME", tmpDir.Join("cache").String())
+	t.Setenv("HOME", tmpDir.String())
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+	}{
+		{"error", context.Background(), errors.New("compilation failed")},
+		{"interrupted", canceledCtx, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := tmpDir.Join(test.name)
+			inoPath := dir.Join("sketch", "sketch.ino")
+			replaced := dir.Join("sketch-dist")
+			for path, content := range map[*paths.Path]string{
+				inoPath:                         "void setup() {}\nvoid loop() {}\n",
+				replaced.Join("previous.txt"):   "previous output",
+				dir.Join("staging", "file.txt"): "staged",
+			} {
+				if err := path.Parent().MkdirAll(); err != nil {
+					t.Fatal(err)
+				}
+				if err := path.WriteFile([]byte(content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tx, err := beginTransaction(inoPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tx.journalPath.NotExist() {
+				t.Fatal("the journal has not been written")
+			}
+			// the staging directory is temporary, the previous output is moved in a backup directory and replaced
+			backupDir := dir.Join("backup")
+			for _, path := range []*paths.Path{dir.Join("staging"), backupDir} {
+				if err := tx.addTemporary(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := backupDir.Mkdir(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.moveAside(replaced, backupDir); err != nil {
+				t.Fatal(err)
+			}
+			created := dir.Join("a", "b")
+			if err := tx.addCreated(firstMissing(created)); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range []*paths.Path{created.Join("new.txt"), replaced.Join("new.txt")} {
+				if err := path.Parent().MkdirAll(); err != nil {
+					t.Fatal(err)
+				}
+				if err := path.WriteFile([]byte("new output")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = tx.end(test.ctx, test.err)
+			var interruptedErr *InterruptedError
+			if test.err != nil && err != test.err {
+				t.Errorf("got error %v, expected %v", err, test.err)
+			} else if test.err == nil && !errors.As(err, &interruptedErr) {
+				t.Errorf("got error %v, expected an InterruptedError", err)
+			}
+			for _, path := range []*paths.Path{dir.Join("a"), dir.Join("staging"), backupDir, replaced.Join("new.txt"), tx.journalPath} {
+				if path.Exist() {
+					t.Errorf("%s has not been removed", path)
+				}
+			}
+			if content, err := replaced.Join("previous.txt").ReadFile(); err != nil || string(content) != "previous output" {
+				t.Errorf("the previous output has not been restored: %q, %v", content, err)
+			}
+		})
+	}
+}
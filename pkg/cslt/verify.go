@@ -0,0 +1,148 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cslt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/sirupsen/logrus"
+)
+
+// VerifyReport contains the outcome of the verification of a single target
+type VerifyReport struct {
+	Fqbn string
+	// Expected is the firmware linked during the precompilation, as recorded in result.json
+	Expected *Firmware
+	// Actual is the firmware linked using the precompiled library
+	Actual *Firmware
+	// Differences contains a description of every difference in the sections, it's empty if the firmwares match
+	Differences []string
+	// Warnings contains the differences that don't make the verification fail, e.g. the sections have the same size
+	// but a different content: the linker can place the code of the archive in a different order
+	Warnings []string
+}
+
+// Matches returns true if the sections of the firmware linked using the precompiled library have the same size
+// of the ones linked during the precompilation
+func (r *VerifyReport) Matches() bool {
+	return len(r.Differences) == 0
+}
+
+// Verify compiles the sketch in distDir, the directory created by Precompile, using its precompiled library,
+// for every target recorded in result.json. Then it compares the firmware produced with the one linked during the precompilation.
+// An error is returned only if the verification cannot be done, e.g. the sketch doesn't compile anymore:
+// the differences are returned in the VerifyReport of every target.
+// The options changing the binary are the ones recorded in result.json, only the other compileOpts are used (e.g. the libraries
+// specified with --library during the precompilation, that could be installed in a different place): compileOpts can be nil
+func Verify(ctx context.Context, distDir string, compileOpts *CompileOptions) ([]*VerifyReport, error) {
+	if err := compileOpts.validate(); err != nil {
+		return nil, err
+	}
+	if err := checkCli(ctx); err != nil {
+		return nil, err
+	}
+
+	libDir, inoPath, resultJson, err := readDist(paths.New(distDir))
+	if err != nil {
+		return nil, &DistError{Path: distDir, Err: err}
+	}
+
+	buildDir, err := paths.MkTempDir("", "arduino-cslt-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer buildDir.RemoveAll()
+
+	var reports []*VerifyReport
+	for _, target := range resultJson.Targets {
+		buildPath := buildDir.Join(fqbnReplacer.Replace(target.Fqbn))
+		// the options used during the precompilation change the binary, they are used again
+		cmdArgs := []string{"compile", "-b", target.CompileOptions.fqbn(target.Fqbn), inoPath.String(), "--library", libDir.String(), "--build-path", buildPath.String(), "--format", "json"}
+		cmdArgs = append(cmdArgs, target.CompileOptions.recordedArgs()...)
+		cmdArgs = append(cmdArgs, compileOpts.localArgs()...)
+		logrus.Infof("running: arduino-cli %s", strings.Join(cmdArgs, " "))
+		cmdOutput, err := exec.CommandContext(ctx, "arduino-cli", cmdArgs...).Output()
+		if ctx.Err() != nil {
+			return nil, &InterruptedError{Err: ctx.Err()}
+		} else if err != nil {
+			var compileOutput cliCompileOutput
+			json.Unmarshal(cmdOutput, &compileOutput)
+			return nil, &CompileError{Fqbn: target.Fqbn, CompilerErr: compileOutput.CompilerErr, Err: err}
+		}
+
+		actual, err := readFirmware(buildPath.Join(inoPath.Base() + ".elf"))
+		if err != nil {
+			return nil, err
+		}
+		report := &VerifyReport{Fqbn: target.Fqbn, Expected: target.Firmware, Actual: actual}
+		if target.Firmware == nil {
+			report.Differences = []string{"the firmware linked during the precompilation has not been recorded"}
+		} else {
+			differences, warnings := compareFirmwares(target.Firmware, actual)
+			report.Differences = differences
+			report.Warnings = append(report.Warnings, warnings...)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// errLegacyResultJson is returned by readDist when the result.json has been written by a version without the multi board support
+var errLegacyResultJson = errors.New("created by an older version of arduino-cslt, it doesn't contain the boards: the library must be created again")
+
+// readDist finds the precompiled library and the sketch inside distDir,
+// it returns the library dir, the path of the sketch .ino and the content of the result.json of the library
+func readDist(distDir *paths.Path) (*paths.Path, *paths.Path, *ResultJson, error) {
+	dirs, err := distDir.ReadDir()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dirs.FilterDirs()
+	for _, libDir := range dirs {
+		resultJsonPath := libDir.Join("extras", "result.json")
+		if !strings.HasPrefix(libDir.Base(), "lib") || !resultJsonPath.Exist() {
+			continue
+		}
+		sketchName := strings.TrimPrefix(libDir.Base(), "lib")
+		inoPath := distDir.Join(sketchName, sketchName+".ino")
+		if !inoPath.Exist() {
+			return nil, nil, nil, errors.New("cannot find the sketch " + inoPath.String())
+		}
+		content, err := resultJsonPath.ReadFile()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var resultJson ResultJson
+		if err := json.Unmarshal(content, &resultJson); err != nil {
+			return nil, nil, nil, errors.New("cannot parse " + resultJsonPath.String() + ": " + err.Error())
+		}
+		// the versions before the multi board support wrote the core and the libraries of the only board at the top level,
+		// without its fqbn: the library must be created again
+		var legacyResultJson struct {
+			CoreInfo *BuildPlatform `json:"coreInfo"`
+			LibsInfo []*UsedLibrary `json:"libsInfo"`
+		}
+		json.Unmarshal(content, &legacyResultJson)
+		if len(resultJson.Targets) == 0 && (legacyResultJson.CoreInfo != nil || legacyResultJson.LibsInfo != nil) {
+			return nil, nil, nil, fmt.Errorf("%s: %w", resultJsonPath.String(), errLegacyResultJson)
+		} else if len(resultJson.Targets) == 0 {
+			return nil, nil, nil, errors.New(resultJsonPath.String() + " doesn't contain any board")
+		}
+		for _, target := range resultJson.Targets {
+			// result.json written by older versions doesn't contain the folder, it was always {build.mcu}
+			if target.PrecompiledFolder == "" {
+				target.PrecompiledFolder = target.BuildMcu
+			}
+		}
+		return libDir, inoPath, &resultJson, nil
+	}
+	return nil, nil, nil, errors.New("cannot find a precompiled library containing extras/result.json")
+}